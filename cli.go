@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iburinoc/wg-docker-net/wg"
+)
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return fmt.Sprintf("%v ago", time.Since(t).Round(time.Second))
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func parseArgs(name, usage string) (*flag.FlagSet, *bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s %s\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+	jsonOutput := flags.Bool("json", false, "print json instead of human readable output")
+	return flags, jsonOutput
+}
+
+func checkArgs(flags *flag.FlagSet, nargs int) error {
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return fmt.Errorf("%s expects %d argument(s), got %d", flags.Name(), nargs, flags.NArg())
+	}
+	return nil
+}
+
+func listNetworks(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("list", "[-json]")
+	flags.Parse(args)
+	if err := checkArgs(flags, 0); err != nil {
+		return err
+	}
+
+	networks, err := client.Networks()
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(networks)
+	}
+
+	table := newTable()
+	fmt.Fprintf(table, "NETWORK ID\tNAMESPACE\tSUBNET\tBRIDGE\tENDPOINTS\n")
+	for _, net := range networks {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\n", wg.ShortId(net.ID), net.Namespace, net.Subnet, net.BridgeAddress, net.Endpoints)
+	}
+	return table.Flush()
+}
+
+func printPeers(peers []*wg.PeerStatus) error {
+	table := newTable()
+	fmt.Fprintf(table, "PUBLIC KEY\tENDPOINT\tALLOWED IPS\tHANDSHAKE\tRX\tTX\tSTATUS\n")
+	for _, peer := range peers {
+		status := "ok"
+		if peer.Stale {
+			status = fmt.Sprintf("stale since %v", peer.StaleSince.Format(time.RFC3339))
+		}
+		endpoint := peer.Endpoint
+		if endpoint == "" {
+			endpoint = "(none)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", peer.PublicKey, endpoint, strings.Join(peer.AllowedIPs, ","),
+			formatAge(peer.LatestHandshake), formatBytes(peer.RxBytes), formatBytes(peer.TxBytes), status)
+	}
+	return table.Flush()
+}
+
+func inspectNetwork(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("inspect", "[-json] <network>")
+	flags.Parse(args)
+	if err := checkArgs(flags, 1); err != nil {
+		return err
+	}
+
+	info, err := client.Network(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(info)
+	}
+
+	table := newTable()
+	fmt.Fprintf(table, "Network:\t%s\n", info.ID)
+	fmt.Fprintf(table, "Namespace:\t%s\n", info.Namespace)
+	fmt.Fprintf(table, "Subnet:\t%s\n", info.Subnet)
+	fmt.Fprintf(table, "Bridge address:\t%s\n", info.BridgeAddress)
+	fmt.Fprintf(table, "Wireguard interface:\t%s (%s, port %d)\n", info.WireguardInterface, info.WireguardAddress, info.ListenPort)
+	fmt.Fprintf(table, "Public key:\t%s\n", info.PublicKey)
+	fmt.Fprintf(table, "Endpoint:\t%s\n", info.Endpoint)
+	fmt.Fprintf(table, "Outbound interface:\t%s (%s)\n", info.OutboundInterface, info.OutboundAddress)
+	fmt.Fprintf(table, "Masquerade:\t%v\n", info.Masquerade)
+	fmt.Fprintf(table, "Routed:\t%v\n", info.Routed)
+	fmt.Fprintf(table, "Last key rotation:\t%s\n", formatAge(info.LastRotation))
+	fmt.Fprintf(table, "Allocator:\t%d/%d addresses used\n", info.Allocator.Used, info.Allocator.Size)
+	if info.IpamPool != "" {
+		fmt.Fprintf(table, "Ipam pool:\t%s\n", info.IpamPool)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nIptables rules:\n")
+	for _, rule := range info.IptablesRules {
+		state := "present"
+		if !rule.Present {
+			state = "MISSING"
+		}
+		fmt.Printf("  [%s] -t %s -A %s %s\n", state, rule.Table, rule.Chain, strings.Join(rule.Rule, " "))
+	}
+
+	fmt.Printf("\nEndpoints:\n")
+	table = newTable()
+	fmt.Fprintf(table, "ENDPOINT ID\tADDRESS\tMAC ADDRESS\tSTATUS\tINTERFACE\n")
+	for _, endpoint := range info.EndpointDetails {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", wg.ShortId(endpoint.ID), endpoint.Address, endpoint.MacAddress, endpoint.Status, endpoint.Interface)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nPeers:\n")
+	return printPeers(info.Peers)
+}
+
+func listPeers(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("peers", "[-json] <network>")
+	flags.Parse(args)
+	if err := checkArgs(flags, 1); err != nil {
+		return err
+	}
+
+	peers, err := client.Peers(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(peers)
+	}
+	return printPeers(peers)
+}
+
+func publicKey(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("pubkey", "[-json] <network>")
+	flags.Parse(args)
+	if err := checkArgs(flags, 1); err != nil {
+		return err
+	}
+
+	response, err := client.PublicKey(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(response)
+	}
+	fmt.Println(response.PublicKey)
+	return nil
+}
+
+func exportPeer(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("export-peer", "[-json] [-new] <network>")
+	var newPeer = flags.Bool("new", false, "generate a keypair and address for a new peer and print its full config")
+	flags.Parse(args)
+	if err := checkArgs(flags, 1); err != nil {
+		return err
+	}
+
+	if !*newPeer {
+		response, err := client.PeerConfig(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if *jsonOutput {
+			return printJSON(response)
+		}
+		fmt.Print(response.PeerBlock)
+		return nil
+	}
+
+	response, err := client.CreatePeer(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(response)
+	}
+	fmt.Print(response.Config)
+	fmt.Fprintf(os.Stderr, "\nAdded peer %s with address %s to network %s\n", response.PublicKey, response.Address, response.NetworkID)
+	return nil
+}
+
+func printChecks(checks []*wg.Check) bool {
+	ok := true
+	for _, check := range checks {
+		state := "PASS"
+		if !check.Ok {
+			state = "FAIL"
+			ok = false
+		}
+		fmt.Printf("[%s] %s", state, check.Name)
+		if check.Detail != "" {
+			fmt.Printf(": %s", check.Detail)
+		}
+		fmt.Printf("\n")
+		if check.Fix != "" {
+			fmt.Printf("       fix: %s\n", check.Fix)
+		}
+	}
+	return ok
+}
+
+func doctor(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("doctor", "[-json] [-probe] [network]")
+	var probe = flags.Bool("probe", false, "ping each peer from the network's namespace")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("doctor expects at most one network")
+	}
+
+	checks := wg.HostChecks()
+	daemon := &wg.Check{Name: "daemon is reachable over the admin socket", Ok: true}
+	networks, err := client.Networks()
+	if err != nil {
+		daemon.Ok = false
+		daemon.Detail = err.Error()
+		daemon.Fix = "Start the plugin, or pass the right socket with -admin"
+	}
+	checks = append(checks, daemon)
+
+	ids := make([]string, 0)
+	if flags.NArg() == 1 {
+		ids = append(ids, flags.Arg(0))
+	} else {
+		for _, net := range networks {
+			ids = append(ids, net.ID)
+		}
+	}
+
+	report := map[string][]*wg.Check{"host": checks}
+	ok := true
+	if !*jsonOutput {
+		fmt.Printf("Host:\n")
+		ok = printChecks(checks)
+	}
+	for _, id := range ids {
+		networkChecks, err := client.Diagnose(id, *probe)
+		if err != nil {
+			return err
+		}
+		report[id] = networkChecks
+		if !*jsonOutput {
+			fmt.Printf("\nNetwork %s:\n", wg.ShortId(id))
+			ok = printChecks(networkChecks) && ok
+		}
+	}
+
+	if *jsonOutput {
+		return printJSON(report)
+	}
+	if !ok {
+		return fmt.Errorf("Some checks failed")
+	}
+	return nil
+}
+
+func cleanup(client *wg.AdminClient, conf *wg.Config, args []string) error {
+	flags, jsonOutput := parseArgs("cleanup", "[-json] [-force]")
+	var force = flags.Bool("force", false, "clean up even if the daemon appears to be running")
+	flags.Parse(args)
+	if err := checkArgs(flags, 0); err != nil {
+		return err
+	}
+
+	if _, err := client.Networks(); err == nil && !*force {
+		return fmt.Errorf("The daemon is running, stop it first or pass -force")
+	}
+
+	done, err := wg.Cleanup(conf)
+	if *jsonOutput {
+		if jsonErr := printJSON(done); jsonErr != nil {
+			return jsonErr
+		}
+	} else {
+		for _, action := range done {
+			fmt.Println(action)
+		}
+		if len(done) == 0 && err == nil {
+			fmt.Println("Nothing to clean up")
+		}
+	}
+	return err
+}
+
+func printOptions(title string, options []*wg.Option) error {
+	fmt.Printf("%s options:\n", title)
+	if len(options) == 0 {
+		fmt.Printf("  none\n")
+		return nil
+	}
+	table := newTable()
+	fmt.Fprintf(table, "  NAME\tTYPE\tDEFAULT\tDESCRIPTION\n")
+	for _, option := range options {
+		def := option.Default
+		if option.Required {
+			def = "required"
+		} else if def == "" {
+			def = "-"
+		}
+		fmt.Fprintf(table, "  %s\t%s\t%s\t%s\n", option.Name, option.Type, def, option.Description)
+	}
+	return table.Flush()
+}
+
+func showOptions(args []string) error {
+	flags, jsonOutput := parseArgs("options", "[-json]")
+	flags.Parse(args)
+	if err := checkArgs(flags, 0); err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return printJSON(map[string][]*wg.Option{
+			"network":  wg.NetworkOptions,
+			"endpoint": wg.EndpointOptions,
+			"ipam":     wg.IpamOptions,
+		})
+	}
+	fmt.Printf("Network options are passed with docker network create -o name=value.\n\n")
+	if err := printOptions("Network", wg.NetworkOptions); err != nil {
+		return err
+	}
+	fmt.Printf("\nEndpoint options are passed with docker network connect --driver-opt name=value.\n\n")
+	if err := printOptions("Endpoint", wg.EndpointOptions); err != nil {
+		return err
+	}
+	fmt.Printf("\nIpam options are passed with docker network create --ipam-driver wg-ipam --ipam-opt name=value.\n\n")
+	return printOptions("Ipam", wg.IpamOptions)
+}
+
+// Prints the config the daemon would run with given the same flags, which is
+// only the config file and defaults if no flags are passed.
+func showConfig(conf *wg.Config, args []string) error {
+	flags, jsonOutput := parseArgs("config", "[-json]")
+	flags.Parse(args)
+	if err := checkArgs(flags, 0); err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		return printJSON(conf)
+	}
+	return conf.Dump(os.Stdout)
+}
+
+func validate(args []string) error {
+	flags, jsonOutput := parseArgs("validate", "[-json] <conf>")
+	flags.Parse(args)
+	if err := checkArgs(flags, 1); err != nil {
+		return err
+	}
+
+	conf, err := wg.ParseWgConfig(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s is invalid: %v", flags.Arg(0), err)
+	}
+	if *jsonOutput {
+		return printJSON(conf)
+	}
+
+	table := newTable()
+	fmt.Fprintf(table, "Address:\t%s\n", conf.Net)
+	fmt.Fprintf(table, "Listen port:\t%d\n", conf.ListenPort)
+	if conf.HasPrivateKey {
+		fmt.Fprintf(table, "Private key:\tfrom config\n")
+	} else {
+		fmt.Fprintf(table, "Private key:\tgenerated by the driver\n")
+	}
+	for _, peer := range conf.Peers {
+		endpoint := peer.Endpoint
+		if endpoint == "" {
+			endpoint = "(none)"
+		}
+		fmt.Fprintf(table, "Peer:\t%s endpoint %s allowed %d network(s)\n", peer.PublicKey, endpoint, len(peer.AllowedIPs))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", flags.Arg(0))
+	return nil
+}
+
+func setLogLevel(client *wg.AdminClient, args []string) error {
+	flags, jsonOutput := parseArgs("loglevel", "[-json] [level]")
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("loglevel expects at most one level")
+	}
+
+	var response *wg.LogLevelResponse
+	var err error
+	if flags.NArg() == 1 {
+		response, err = client.SetLogLevel(flags.Arg(0))
+	} else {
+		response, err = client.LogLevel()
+	}
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(response)
+	}
+	fmt.Println(response.Level)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [flags] [command] [args]
+
+Commands:
+  serve                   run the plugin (default)
+  list                    list networks managed by the running daemon
+  inspect <network>       show everything the driver set up for a network
+  peers <network>         show wireguard peer status for a network
+  pubkey <network>        print the wireguard public key of a network
+  export-peer <network>   print a wg-quick [Peer] block for the remote side
+  doctor [network]        check the host, daemon and networks for common problems
+  cleanup                 tear down networks, links and chains left behind by a stopped daemon
+  validate <conf>         check a wireguard config file
+  config                  print the effective daemon config
+  options                 describe the options networks, endpoints and ipam pools accept
+  loglevel [level]        show or change the log level of the running daemon
+
+Run '%s <command> -h' for the flags of a command.
+
+Flags:
+`, os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
@@ -3,8 +3,9 @@ module github.com/iburinoc/wg-docker-net
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.4.1
 	github.com/coreos/go-iptables v0.5.0
-	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf // indirect
+	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf
 	github.com/davecgh/go-spew v1.1.1
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-plugins-helpers v0.0.0-20200102110956-c9a8a2d92ccc
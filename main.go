@@ -3,11 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"github.com/coreos/go-systemd/daemon"
+	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/go-plugins-helpers/network"
 
 	"github.com/iburinoc/wg-docker-net/wg"
@@ -21,34 +23,215 @@ func main() {
 }
 
 func run() error {
-	var socket = flag.String("socket", "wg", "where to create the unix socket")
+	defaults := wg.DefaultConfig()
+	var configPath = flag.String("config", wg.DefaultConfigPath, "daemon config file, flags given on the command line take precedence over it")
+	flag.String("socket", defaults.Socket, "where to create the unix socket")
+	flag.String("ipam-socket", defaults.IpamSocket, "where to create the unix socket of the ipam plugin, disabled if empty")
+	flag.String("admin", defaults.AdminSocket, "where to create the admin unix socket")
+	flag.String("state", defaults.StateDir, "directory for persistent state such as generated keys")
+	flag.String("metrics", defaults.Metrics, "address to serve prometheus metrics on, disabled if empty")
+	flag.String("log-level", defaults.LogLevel, "minimum level to log: debug, info, warn or error")
+	flag.String("log-format", defaults.LogFormat, "log format: logfmt, json or journald")
+	flag.String("shutdown", defaults.Shutdown, "what to do with networks on exit: detach leaves them running for the next start to adopt, teardown deletes them")
+	flag.Usage = usage
 	flag.Parse()
 
-	log.Printf("Creating socket at %s\n", *socket)
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	wg.SetConfig(conf)
+
+	client := wg.NewAdminClient(conf.AdminSocket)
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		level, err := wg.ParseLevel(conf.LogLevel)
+		if err != nil {
+			return err
+		}
+		if err = wg.ConfigureLogging(conf.LogFormat, level); err != nil {
+			return err
+		}
+		return serve(conf, *configPath)
+	case "list":
+		return listNetworks(client, args)
+	case "inspect":
+		return inspectNetwork(client, args)
+	case "peers":
+		return listPeers(client, args)
+	case "pubkey":
+		return publicKey(client, args)
+	case "export-peer":
+		return exportPeer(client, args)
+	case "doctor":
+		return doctor(client, args)
+	case "cleanup":
+		return cleanup(client, conf, args)
+	case "validate":
+		return validate(args)
+	case "options":
+		return showOptions(args)
+	case "config":
+		return showConfig(conf, args)
+	case "loglevel":
+		return setLogLevel(client, args)
+	case "help":
+		usage()
+		return nil
+	default:
+		usage()
+		return fmt.Errorf("Unknown command: %s", cmd)
+	}
+}
+
+// Reads the config file and applies the flags that were given explicitly on
+// top of it.  The file only has to exist if -config was given.
+func loadConfig(path string) (*wg.Config, error) {
+	required := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			required = true
+		}
+	})
+	conf, err := wg.LoadConfig(path, required)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]*string{
+		"socket":      &conf.Socket,
+		"ipam-socket": &conf.IpamSocket,
+		"admin":       &conf.AdminSocket,
+		"state":       &conf.StateDir,
+		"metrics":     &conf.Metrics,
+		"log-level":   &conf.LogLevel,
+		"log-format":  &conf.LogFormat,
+		"shutdown":    &conf.Shutdown,
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if field, ok := overrides[f.Name]; ok {
+			*field = f.Value.String()
+		}
+	})
+	if err = conf.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	return conf, nil
+}
+
+func reloadConfig(path string) {
+	logger := wg.GetLogger()
+	notify(daemon.SdNotifyReloading)
+	defer notify(daemon.SdNotifyReady)
 
-	driver, err := wg.NewDriver()
+	conf, err := loadConfig(path)
+	if err == nil {
+		var ignored []string
+		ignored, err = wg.ReloadConfig(conf)
+		if len(ignored) > 0 {
+			logger.Warn("Some settings only take effect on restart", "settings", strings.Join(ignored, ","))
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to reload config, keeping the current one", "path", path, "error", err)
+		return
+	}
+	logger.Info("Reloaded config", "path", path)
+}
+
+func serve(conf *wg.Config, configPath string) error {
+	logger := wg.GetLogger()
+
+	pluginListener, ipamListener, adminListener, err := activationListeners()
+	if err != nil {
+		return fmt.Errorf("Failed to get sockets from systemd: %v", err)
+	}
+
+	driver, err := wg.NewDriver(conf)
 	if err != nil {
 		return err
 	}
 
 	stop := make(chan os.Signal, 1)
-	result := make(chan error, 1)
+	result := make(chan error, 4)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
-	handler := network.NewHandler(driver)
+	handler := network.NewHandler(driver.Instrumented())
 	go func() {
-		err := handler.ServeUnix(*socket, 0)
+		var err error
+		if pluginListener != nil {
+			logger.Info("Serving on socket from systemd", "addr", pluginListener.Addr())
+			err = handler.Serve(pluginListener)
+		} else {
+			logger.Info("Creating socket", "path", conf.Socket)
+			err = handler.ServeUnix(conf.Socket, 0)
+		}
 		result <- err
 	}()
-	log.Printf("Serving")
+	if ipamListener != nil || conf.IpamSocket != "" {
+		ipamHandler := ipam.NewHandler(driver.Ipam())
+		go func() {
+			var err error
+			if ipamListener != nil {
+				logger.Info("Serving ipam on socket from systemd", "addr", ipamListener.Addr())
+				err = ipamHandler.Serve(ipamListener)
+			} else {
+				logger.Info("Creating ipam socket", "path", conf.IpamSocket)
+				err = ipamHandler.ServeUnix(conf.IpamSocket, 0)
+			}
+			result <- fmt.Errorf("Ipam plugin stopped: %v", err)
+		}()
+	}
+	go func() {
+		var err error
+		if adminListener != nil {
+			err = driver.ServeAdminListener(adminListener)
+		} else {
+			err = driver.ServeAdmin(conf.AdminSocket)
+		}
+		result <- fmt.Errorf("Admin api stopped: %v", err)
+	}()
+	if conf.Metrics != "" {
+		go func() {
+			err := driver.ServeMetrics(conf.Metrics)
+			result <- fmt.Errorf("Metrics listener stopped: %v", err)
+		}()
+	}
+	logger.Info("Serving")
+	notify(daemon.SdNotifyReady)
+
+	watchdogStop := make(chan struct{})
+	go watchdog(driver, watchdogStop)
 
-	select {
-	case res := <-result:
-		err = res
-	case sig := <-stop:
-		err = fmt.Errorf("Received signal: %v", sig)
+wait:
+	for {
+		select {
+		case err = <-result:
+			break wait
+		case sig := <-stop:
+			err = fmt.Errorf("Received signal: %v", sig)
+			break wait
+		case <-reload:
+			reloadConfig(configPath)
+		}
 	}
+	close(watchdogStop)
+	notify(daemon.SdNotifyStopping)
+	notify(fmt.Sprintf("STATUS=Stopping: %v", err))
 
+	if conf.Shutdown == wg.ShutdownDetach {
+		if detachErr := driver.Detach(); detachErr != nil {
+			return fmt.Errorf("%v, failed to detach driver: %v", err, detachErr)
+		}
+		return err
+	}
 	delErr := driver.Delete()
 	if delErr != nil {
 		return fmt.Errorf("%v, failed to delete driver: %v", err, delErr)
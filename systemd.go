@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coreos/go-systemd/activation"
+	"github.com/coreos/go-systemd/daemon"
+
+	"github.com/iburinoc/wg-docker-net/wg"
+)
+
+const (
+	adminSocketName = "admin"
+	ipamSocketName  = "ipam"
+)
+
+// Returns the plugin, ipam and admin listeners passed in by systemd socket
+// activation, any of which is nil if it wasn't passed.  The ipam and admin
+// sockets are recognised by FileDescriptorName=ipam and admin, any other
+// socket serves the plugin.
+func activationListeners() (net.Listener, net.Listener, net.Listener, error) {
+	named, err := activation.ListenersWithNames()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var plugin, ipam, admin net.Listener
+	for name, listeners := range named {
+		for _, l := range listeners {
+			switch {
+			case name == adminSocketName && admin == nil:
+				admin = l
+			case name == ipamSocketName && ipam == nil:
+				ipam = l
+			case name != adminSocketName && name != ipamSocketName && plugin == nil:
+				plugin = l
+			default:
+				l.Close()
+				return nil, nil, nil, fmt.Errorf("Unexpected extra socket %s passed by systemd", name)
+			}
+		}
+	}
+	return plugin, ipam, admin, nil
+}
+
+func notify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		wg.GetLogger().Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// Pings the systemd watchdog for as long as the driver keeps serving requests.
+// A ping is skipped when the driver lock can't be taken within a quarter of
+// WatchdogSec, so a wedged driver gets restarted while a create holding the
+// lock for a few seconds doesn't.
+func watchdog(driver *wg.Driver, stop <-chan struct{}) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		wg.GetLogger().Warn("Failed to read watchdog settings", "error", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	wg.GetLogger().Info("Enabling systemd watchdog", "interval", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !driver.Responsive(interval / 4) {
+			wg.GetLogger().Warn("Driver is not taking requests, skipping watchdog ping")
+			continue
+		}
+		count := driver.NetworkCount()
+		notify(fmt.Sprintf("%s\nSTATUS=Serving %d network(s)", daemon.SdNotifyWatchdog, count))
+	}
+}
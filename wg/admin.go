@@ -0,0 +1,452 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type PublicKeyResponse struct {
+	NetworkID string
+	PublicKey string
+}
+
+type ErrorResponse struct {
+	Err string
+}
+
+type EndpointSummary struct {
+	ID         string
+	Address    string
+	MacAddress string
+	Status     EndpointStatus
+	Interface  string
+}
+
+type AllocatorSummary struct {
+	Used int
+	Size int
+}
+
+type NetworkSummary struct {
+	ID            string
+	Namespace     string
+	Subnet        string
+	BridgeAddress string
+	PublicKey     string
+	Endpoints     int
+}
+
+type NetworkInfo struct {
+	NetworkSummary
+	WireguardInterface string
+	WireguardAddress   string
+	ListenPort         uint
+	Endpoint           string
+	OutboundInterface  string
+	OutboundAddress    string
+	AuxAddresses       map[string]string
+	Masquerade         bool
+	Routed             bool
+	LastRotation       time.Time
+	IptablesRules      []*IptablesRule
+	EndpointDetails    []*EndpointSummary
+	Allocator          AllocatorSummary
+	IpamPool           string `json:",omitempty"`
+	Peers              []*PeerStatus
+}
+
+func (t *Network) namespaceName() string {
+	if t.name != nil {
+		return *t.name
+	}
+	return fmt.Sprintf("anonymous (fd %d)", t.ns)
+}
+
+// Callers hold the driver lock.
+func (t *Network) Summary() *NetworkSummary {
+	return t.summary(len(t.endpoints))
+}
+
+func (t *Network) summary(endpoints int) *NetworkSummary {
+	return &NetworkSummary{
+		ID:            t.id,
+		Namespace:     t.namespaceName(),
+		Subnet:        t.subnet.String(),
+		BridgeAddress: t.bridgeNet.String(),
+		PublicKey:     t.PublicKey(),
+		Endpoints:     endpoints,
+	}
+}
+
+// Takes the endpoints as a snapshot, they are only safe to read under the
+// driver lock.
+func (t *Network) Info(endpoints endpointTable) (*NetworkInfo, error) {
+	rules, err := t.iptables.ListForwarding(t.rootNs, t.outboundAddr, t.endpointAddr(), t.conf.ListenPort)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list iptables rules: %v", err)
+	}
+
+	summaries := make([]*EndpointSummary, 0, len(endpoints))
+	for id, endpoint := range endpoints {
+		summaries = append(summaries, &EndpointSummary{
+			ID:         id,
+			Address:    endpoint.Addr.String(),
+			MacAddress: endpoint.Mac.String(),
+			Status:     endpoint.Status,
+			Interface:  endpoint.Interface,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+
+	peers := t.PeerStatus()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+
+	t.mu.Lock()
+	lastRotation := t.lastRotation
+	t.mu.Unlock()
+
+	return &NetworkInfo{
+		NetworkSummary:     *t.summary(len(endpoints)),
+		WireguardInterface: t.wgInterface(),
+		WireguardAddress:   t.conf.Net.String(),
+		ListenPort:         t.conf.ListenPort,
+		Endpoint:           t.endpointAddr().String(),
+		OutboundInterface:  t.outboundIntf.Attrs().Name,
+		OutboundAddress:    t.outboundAddr.String(),
+		AuxAddresses:       t.auxAddressStrings(),
+		Masquerade:         t.masquerade,
+		Routed:             t.routed,
+		LastRotation:       lastRotation,
+		IptablesRules:      rules,
+		EndpointDetails:    summaries,
+		Allocator:          AllocatorSummary{t.ipAllocator.Used(), t.ipAllocator.Size()},
+		IpamPool:           t.ipamPool,
+		Peers:              peers,
+	}, nil
+}
+
+// Only lets root connect, regardless of the permissions on the socket file.
+type rootOnlyListener struct {
+	*net.UnixListener
+}
+
+func (t *rootOnlyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := t.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUid(conn)
+		if err != nil {
+			logger.Warn("Failed to get credentials of admin api client", "error", err)
+			conn.Close()
+			continue
+		}
+		if uid != 0 {
+			logger.Warn("Rejected admin api connection", "uid", uid)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func peerUid(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, credErr
+	}
+	return cred.Uid, nil
+}
+
+func writeResponse(w http.ResponseWriter, response interface{}, err error) {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if encErr := json.NewEncoder(w).Encode(response); encErr != nil {
+		logger.Error("Failed to encode admin response", "error", encErr)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if encErr := json.NewEncoder(w).Encode(&ErrorResponse{err.Error()}); encErr != nil {
+		logger.Error("Failed to encode admin response", "error", encErr)
+	}
+}
+
+// Serves the admin api on a unix socket only accessible by root.
+func (t *Driver) ServeAdmin(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	return t.ServeAdminListener(listener)
+}
+
+// Serves the admin api on an existing listener, such as one passed in by
+// systemd.  Connections from anyone but root are rejected.
+func (t *Driver) ServeAdminListener(l net.Listener) error {
+	listener, ok := l.(*net.UnixListener)
+	if !ok {
+		return fmt.Errorf("Admin api must be served on a unix socket, got %v", l.Addr())
+	}
+	logger.Info("Serving admin api", "addr", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loglevel", handleLogLevel)
+	mux.HandleFunc("/networks", t.handleNetworks)
+	mux.HandleFunc("/networks/", t.handleNetwork)
+	return http.Serve(&rootOnlyListener{listener}, mux)
+}
+
+type LogLevelResponse struct {
+	Level string
+}
+
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		level, err := ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		SetLogLevel(level)
+		logger.Info("Changed log level", "level", level)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeResponse(w, &LogLevelResponse{LogLevel().String()}, nil)
+}
+
+func (t *Driver) handleNetworks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	networks := make([]*NetworkSummary, 0, len(t.networks))
+	for _, net := range t.networks {
+		networks = append(networks, net.Summary())
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].ID < networks[j].ID })
+	writeResponse(w, networks, nil)
+}
+
+func (t *Driver) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/networks/"), "/")
+	if len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, resource := parts[0], ""
+	if len(parts) == 2 {
+		resource = parts[1]
+	}
+
+	// Only the lookup and the endpoints need the driver lock, the rest runs
+	// wg and iptables and must not hold up docker's requests
+	t.mu.Lock()
+	net, err := t.findNetwork(id)
+	var endpoints endpointTable
+	if net != nil {
+		endpoints = net.endpoints.snapshot()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if net == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Network %s not found", id))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && resource == "":
+		info, err := net.Info(endpoints)
+		writeResponse(w, info, err)
+	case r.Method == http.MethodGet && resource == "peers":
+		peers := net.PeerStatus()
+		sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+		writeResponse(w, peers, nil)
+	case r.Method == http.MethodGet && resource == "doctor":
+		probe := r.URL.Query().Get("probe") == "true"
+		writeResponse(w, net.Diagnose(probe, endpoints), nil)
+	case r.Method == http.MethodGet && resource == "publickey":
+		writeResponse(w, &PublicKeyResponse{net.id, net.PublicKey()}, nil)
+	case r.Method == http.MethodGet && resource == "peer":
+		writeResponse(w, &PeerConfigResponse{net.id, net.PeerBlock()}, nil)
+	case r.Method == http.MethodPost && resource == "peers":
+		response, err := net.CreatePeer()
+		writeResponse(w, response, err)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type AdminClient struct {
+	client *http.Client
+}
+
+func NewAdminClient(path string) *AdminClient {
+	transport := &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}
+	return &AdminClient{&http.Client{Transport: transport}}
+}
+
+func (t *AdminClient) get(path string, response interface{}) error {
+	resp, err := t.client.Get("http://wg-docker-net" + path)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(path, resp, response)
+}
+
+func (t *AdminClient) put(path string, response interface{}) error {
+	req, err := http.NewRequest(http.MethodPut, "http://wg-docker-net"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(path, resp, response)
+}
+
+func (t *AdminClient) post(path string, response interface{}) error {
+	resp, err := t.client.Post("http://wg-docker-net"+path, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(path, resp, response)
+}
+
+func decodeResponse(path string, resp *http.Response, response interface{}) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Err == "" {
+			return fmt.Errorf("Request to %s failed: %s", path, resp.Status)
+		}
+		return fmt.Errorf("%s", errResp.Err)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (t *AdminClient) PublicKey(network string) (*PublicKeyResponse, error) {
+	var response PublicKeyResponse
+	if err := t.get("/networks/"+network+"/publickey", &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *AdminClient) PeerConfig(network string) (*PeerConfigResponse, error) {
+	var response PeerConfigResponse
+	if err := t.get("/networks/"+network+"/peer", &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *AdminClient) CreatePeer(network string) (*NewPeerResponse, error) {
+	var response NewPeerResponse
+	if err := t.post("/networks/"+network+"/peers", &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *AdminClient) Networks() ([]*NetworkSummary, error) {
+	var response []*NetworkSummary
+	if err := t.get("/networks", &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *AdminClient) Network(network string) (*NetworkInfo, error) {
+	var response NetworkInfo
+	if err := t.get("/networks/"+network, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *AdminClient) Peers(network string) ([]*PeerStatus, error) {
+	var response []*PeerStatus
+	if err := t.get("/networks/"+network+"/peers", &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *AdminClient) Diagnose(network string, probe bool) ([]*Check, error) {
+	var response []*Check
+	if err := t.get(fmt.Sprintf("/networks/%s/doctor?probe=%v", network, probe), &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (t *AdminClient) LogLevel() (*LogLevelResponse, error) {
+	var response LogLevelResponse
+	if err := t.get("/loglevel", &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (t *AdminClient) SetLogLevel(level string) (*LogLevelResponse, error) {
+	var response LogLevelResponse
+	if err := t.put("/loglevel?level="+url.QueryEscape(level), &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
@@ -0,0 +1,63 @@
+package wg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+const ethPArp = 0x0806
+
+// Docker's bridge driver does the same, so a container keeps its mac address
+// across restarts as long as it keeps its ip.
+func macFromIP(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	return net.HardwareAddr{0x02, 0x42, ip4[0], ip4[1], ip4[2], ip4[3]}
+}
+
+// Packet sockets take the protocol in network byte order, that is a value
+// whose bytes in memory are big endian whatever the host's own order.
+func htons(val uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], val)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
+
+func gratuitousArp(ip net.IP, mac net.HardwareAddr) []byte {
+	frame := make([]byte, 0, 42)
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	frame = append(frame, mac...)
+	frame = append(frame, 0x08, 0x06)
+	// Ethernet, ipv4, address lengths and a reply
+	frame = append(frame, 0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x02)
+	frame = append(frame, mac...)
+	frame = append(frame, ip.To4()...)
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	frame = append(frame, ip.To4()...)
+	return frame
+}
+
+// Sends a gratuitous arp reply out of link in ns, so that whatever is on the
+// other side updates its neighbour entry for ip right away.
+func sendGratuitousArp(ns netns.NsHandle, link netlink.Link, ip net.IP, mac net.HardwareAddr) error {
+	return inNamespace(ns, func() error {
+		fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+		if err != nil {
+			return fmt.Errorf("Failed to open packet socket: %v", err)
+		}
+		defer syscall.Close(fd)
+
+		addr := &syscall.SockaddrLinklayer{
+			Protocol: htons(ethPArp),
+			Ifindex:  link.Attrs().Index,
+			Halen:    6,
+		}
+		copy(addr.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		return syscall.Sendto(fd, gratuitousArp(ip, mac), 0, addr)
+	})
+}
@@ -0,0 +1,86 @@
+package wg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Removes everything a previous instance of the driver may have left behind,
+// including networks it detached from.  Must not be run while the driver is
+// serving.
+func Cleanup(conf *Config) ([]string, error) {
+	done := make([]string, 0)
+	stateDir := conf.StateDir
+
+	states, err := LoadNetworkStates(stateDir)
+	if err != nil {
+		return done, err
+	}
+	for _, state := range states {
+		if _, err := os.Stat(filepath.Join("/var/run/netns", state.Namespace)); err == nil {
+			if err := netns.DeleteNamed(state.Namespace); err != nil {
+				return done, fmt.Errorf("Failed to delete namespace %s: %v", state.Namespace, err)
+			}
+		}
+		if err := RemoveNetworkState(stateDir, state.ID); err != nil {
+			return done, err
+		}
+		done = append(done, fmt.Sprintf("deleted network %s in namespace %s", ShortId(state.ID), state.Namespace))
+	}
+
+	// Every network is gone, so are the reservations of any that failed
+	// before saving state
+	if err := os.Remove(transitPath(stateDir)); err == nil {
+		done = append(done, "released all transit addresses")
+	} else if !os.IsNotExist(err) {
+		return done, err
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return done, err
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !strings.HasPrefix(name, conf.LinkPrefix) || link.Type() != "veth" {
+			continue
+		}
+		if err := netlink.LinkDel(link); err != nil {
+			return done, fmt.Errorf("Failed to delete link %s: %v", name, err)
+		}
+		done = append(done, fmt.Sprintf("deleted link %s", name))
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		return done, err
+	}
+	chains := []struct{ table, source, chain string }{
+		{nat, source_pre, conf.ChainPrefix + source_pre},
+		{nat, source_post, conf.ChainPrefix + source_post},
+		{filter, source_forward, conf.ChainPrefix + source_forward},
+	}
+	for _, c := range chains {
+		exists, err := ipt.ChainExists(c.table, c.chain)
+		if err != nil {
+			return done, err
+		}
+		if !exists {
+			continue
+		}
+		if err := ipt.DeleteIfExists(c.table, c.source, jumpRule(c.chain)...); err != nil {
+			return done, err
+		}
+		if err := ipt.ClearAndDeleteChain(c.table, c.chain); err != nil {
+			return done, err
+		}
+		done = append(done, fmt.Sprintf("deleted chain %s in table %s", c.chain, c.table))
+	}
+	return done, nil
+}
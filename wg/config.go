@@ -0,0 +1,222 @@
+package wg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	DefaultConfigPath = "/etc/wg-docker-net/config.toml"
+
+	FirewallIptables = "iptables"
+	FirewallNone     = "none"
+
+	ShutdownDetach   = "detach"
+	ShutdownTeardown = "teardown"
+
+	ScopeLocal  = "local"
+	ScopeGlobal = "global"
+)
+
+// Daemon wide settings, read from a toml file with command line flags taking
+// precedence.
+type Config struct {
+	StateDir    string `toml:"state_dir" json:"state_dir"`
+	Socket      string `toml:"socket" json:"socket"`
+	IpamSocket  string `toml:"ipam_socket" json:"ipam_socket"`
+	AdminSocket string `toml:"admin_socket" json:"admin_socket"`
+	Metrics     string `toml:"metrics" json:"metrics"`
+	LogLevel    string `toml:"log_level" json:"log_level"`
+	LogFormat   string `toml:"log_format" json:"log_format"`
+	Shutdown    string `toml:"shutdown" json:"shutdown"`
+	Scope       string `toml:"scope" json:"scope"`
+
+	Firewall string `toml:"firewall" json:"firewall"`
+	// Link-local ranges such as 169.254.0.0/16 work as well and cannot clash
+	// with routed networks
+	TransitRange string `toml:"transit_range" json:"transit_range"`
+	LinkPrefix   string `toml:"link_prefix" json:"link_prefix"`
+	ChainPrefix  string `toml:"chain_prefix" json:"chain_prefix"`
+	BridgeName   string `toml:"bridge_name" json:"bridge_name"`
+	// Used to keep transit addresses clear of docker's networks, empty
+	// disables the check
+	DockerSocket string `toml:"docker_socket" json:"docker_socket"`
+
+	// Applied to every network that does not set the option itself
+	NetworkDefaults map[string]string `toml:"network_defaults" json:"network_defaults"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		StateDir:        "/var/lib/wg-docker-net",
+		Socket:          "wg",
+		IpamSocket:      "wg-ipam",
+		AdminSocket:     "/run/wg-docker-net/admin.sock",
+		LogLevel:        "info",
+		LogFormat:       FormatLogfmt,
+		Shutdown:        ShutdownDetach,
+		Scope:           ScopeLocal,
+		Firewall:        FirewallIptables,
+		TransitRange:    "172.31.0.0/16",
+		LinkPrefix:      "wgdocknet",
+		ChainPrefix:     "WG-DOCKER-",
+		BridgeName:      "br0",
+		DockerSocket:    "/var/run/docker.sock",
+		NetworkDefaults: make(map[string]string),
+	}
+}
+
+// Reads the config file at path on top of the defaults.  A missing file is
+// only an error if required is set.
+func LoadConfig(path string, required bool) (*Config, error) {
+	conf := DefaultConfig()
+	if path == "" {
+		return conf, nil
+	}
+
+	md, err := toml.DecodeFile(path, conf)
+	if os.IsNotExist(err) && !required {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config %s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("Unknown settings in %s: %s", path, strings.Join(keys, ", "))
+	}
+	if conf.NetworkDefaults == nil {
+		conf.NetworkDefaults = make(map[string]string)
+	}
+	return conf, nil
+}
+
+func (t *Config) Validate() error {
+	if t.StateDir == "" {
+		return fmt.Errorf("state_dir must be set")
+	}
+	if t.Socket == "" {
+		return fmt.Errorf("socket must be set")
+	}
+	if t.AdminSocket == "" {
+		return fmt.Errorf("admin_socket must be set")
+	}
+	if _, err := ParseLevel(t.LogLevel); err != nil {
+		return err
+	}
+	switch t.LogFormat {
+	case FormatLogfmt, FormatJSON, FormatJournal:
+	default:
+		return fmt.Errorf("Unknown log format %q, expected %s, %s or %s", t.LogFormat, FormatLogfmt, FormatJSON, FormatJournal)
+	}
+	if t.Shutdown != ShutdownDetach && t.Shutdown != ShutdownTeardown {
+		return fmt.Errorf("Invalid shutdown mode %q, expected %s or %s", t.Shutdown, ShutdownDetach, ShutdownTeardown)
+	}
+	if t.Scope != ScopeLocal && t.Scope != ScopeGlobal {
+		return fmt.Errorf("Invalid scope %q, expected %s or %s", t.Scope, ScopeLocal, ScopeGlobal)
+	}
+	if t.Firewall != FirewallIptables && t.Firewall != FirewallNone {
+		return fmt.Errorf("Invalid firewall backend %q, expected %s or %s", t.Firewall, FirewallIptables, FirewallNone)
+	}
+
+	if _, err := parseTransitRange(t.TransitRange); err != nil {
+		return fmt.Errorf("Invalid transit_range: %v", err)
+	}
+	// Link names are limited to 15 characters and get a number appended
+	if t.LinkPrefix == "" || len(t.LinkPrefix) > 10 {
+		return fmt.Errorf("link_prefix must be between 1 and 10 characters")
+	}
+	if t.BridgeName == "" || len(t.BridgeName) > 15 {
+		return fmt.Errorf("bridge_name must be between 1 and 15 characters")
+	}
+	// iptables chain names are limited to 28 characters
+	if t.ChainPrefix == "" || len(t.ChainPrefix+source_post) > 28 {
+		return fmt.Errorf("chain_prefix must be between 1 and %d characters", 28-len(source_post))
+	}
+	if err := validateOptionValues("network", NetworkOptions, t.NetworkDefaults); err != nil {
+		return fmt.Errorf("Invalid network_defaults: %v", err)
+	}
+	return nil
+}
+
+// Writes the config in the same format it is read in.
+func (t *Config) Dump(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(t)
+}
+
+// Fills in the network defaults for options the network does not set.  The
+// daemon wide transit range is the default for the network option.
+func (t *Config) networkOptions(options map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(options)+len(t.NetworkDefaults))
+	merged["transit_range"] = t.TransitRange
+	for name, val := range t.NetworkDefaults {
+		merged[name] = val
+	}
+	for name, val := range options {
+		merged[name] = val
+	}
+	return merged
+}
+
+var (
+	configMu sync.Mutex
+	config   = DefaultConfig()
+)
+
+func SetConfig(conf *Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config = conf
+}
+
+func GetConfig() *Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return config
+}
+
+// Applies a config read while running.  Settings that only take effect on
+// start are kept at their current values and returned so the caller can warn
+// about them.
+func ReloadConfig(conf *Config) ([]string, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	current := GetConfig()
+	reloaded := *conf
+	ignored := make([]string, 0)
+	keep := func(name string, current string, new *string) {
+		if *new != current {
+			ignored = append(ignored, name)
+			*new = current
+		}
+	}
+	keep("state_dir", current.StateDir, &reloaded.StateDir)
+	keep("socket", current.Socket, &reloaded.Socket)
+	keep("ipam_socket", current.IpamSocket, &reloaded.IpamSocket)
+	keep("admin_socket", current.AdminSocket, &reloaded.AdminSocket)
+	keep("metrics", current.Metrics, &reloaded.Metrics)
+	keep("shutdown", current.Shutdown, &reloaded.Shutdown)
+	keep("scope", current.Scope, &reloaded.Scope)
+	keep("firewall", current.Firewall, &reloaded.Firewall)
+	keep("link_prefix", current.LinkPrefix, &reloaded.LinkPrefix)
+	keep("chain_prefix", current.ChainPrefix, &reloaded.ChainPrefix)
+	sort.Strings(ignored)
+
+	level, _ := ParseLevel(reloaded.LogLevel)
+	if err := ConfigureLogging(reloaded.LogFormat, level); err != nil {
+		return nil, err
+	}
+	SetConfig(&reloaded)
+	return ignored, nil
+}
@@ -0,0 +1,316 @@
+package wg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// The 12 character form docker shows ids in.
+func ShortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+type Check struct {
+	Name   string
+	Ok     bool
+	Detail string
+	Fix    string
+}
+
+func commandCheck(name string) *Check {
+	check := &Check{Name: fmt.Sprintf("%s is installed", name)}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = fmt.Sprintf("Install %s and make sure it is in the PATH of the plugin", name)
+		return check
+	}
+	check.Ok = true
+	check.Detail = path
+	return check
+}
+
+func sysctlCheck(path, want, fix string) *Check {
+	name := strings.Replace(strings.TrimPrefix(path, "/proc/sys/"), "/", ".", -1)
+	check := &Check{Name: fmt.Sprintf("%s is %s", name, want)}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = fix
+		return check
+	}
+	value := strings.TrimSpace(string(contents))
+	check.Ok = value == want
+	check.Detail = fmt.Sprintf("%s = %s", name, value)
+	if !check.Ok {
+		check.Fix = fix
+	}
+	return check
+}
+
+// Checks the host prerequisites of the driver, none of which need the driver
+// to be running.
+func HostChecks() []*Check {
+	return []*Check{
+		commandCheck("wg"),
+		commandCheck("wg-quick"),
+		commandCheck("iptables"),
+		sysctlCheck("/proc/sys/net/ipv4/ip_forward", "1", "Enable forwarding with: sysctl -w net.ipv4.ip_forward=1"),
+	}
+}
+
+func linkCheck(nl *netlink.Handle, where, name string, addr net.IP) *Check {
+	check := &Check{Name: fmt.Sprintf("%s link %s is up", where, name)}
+	link, err := nl.LinkByName(name)
+	if err != nil {
+		check.Detail = err.Error()
+		check.Fix = "The link was deleted, recreate the network"
+		return check
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		check.Detail = fmt.Sprintf("state %v", link.Attrs().OperState)
+		check.Fix = fmt.Sprintf("Bring it up with: ip link set %s up", name)
+		return check
+	}
+	if addr == nil {
+		check.Ok = true
+		return check
+	}
+
+	addrs, err := nl.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(addr) {
+			check.Ok = true
+			check.Detail = a.IPNet.String()
+			return check
+		}
+	}
+	check.Detail = fmt.Sprintf("address %v missing", addr)
+	check.Fix = fmt.Sprintf("Re-add the address to %s or recreate the network", name)
+	return check
+}
+
+func ruleCheck(rule *IptablesRule) *Check {
+	check := &Check{
+		Name:   fmt.Sprintf("iptables rule in %s/%s", rule.Table, rule.Chain),
+		Ok:     rule.Present,
+		Detail: strings.Join(rule.Rule, " "),
+	}
+	if !rule.Present {
+		check.Fix = "Something flushed the driver's rules, they are restored by the monitor or by restarting the plugin"
+	}
+	return check
+}
+
+func readSysctl(ns netns.NsHandle, path string) (string, error) {
+	var value string
+	err := inNamespace(ns, func() error {
+		contents, err := ioutil.ReadFile(path)
+		value = strings.TrimSpace(string(contents))
+		return err
+	})
+	return value, err
+}
+
+func (t *Network) routeChecks() []*Check {
+	outer := uintToBytes(bytesToUint(t.outboundAddr.To4()) - 1)
+	check := &Check{Name: fmt.Sprintf("namespace default route via %v", net.IP(outer))}
+	routes, err := t.nl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		check.Detail = err.Error()
+		return []*Check{check}
+	}
+	for _, route := range routes {
+		if (route.Dst == nil || route.Dst.IP.Equal(net.IPv4zero)) && route.Gw.Equal(net.IP(outer)) {
+			check.Ok = true
+		}
+	}
+	if !check.Ok {
+		check.Fix = fmt.Sprintf("Add it with: ip -n <namespace> route add default via %v", net.IP(outer))
+	}
+	return []*Check{check}
+}
+
+func (t *Network) containerChecks(endpoints endpointTable) []*Check {
+	checks := make([]*Check, 0)
+	routes := t.containerRoutes()
+
+	for id, endpoint := range endpoints {
+		if endpoint.Status != EndpointJoined {
+			continue
+		}
+		intf := endpoint.Interface
+		check := linkCheck(t.nl, fmt.Sprintf("endpoint %s", ShortId(id)), intf, nil)
+		if check.Ok && t.routed {
+			checks = append(checks, check)
+			check = t.routeCheck(id, endpoint)
+		} else if check.Ok {
+			link, _ := t.nl.LinkByName(intf)
+			if link.Attrs().MasterIndex != t.bridge.Attrs().Index {
+				check.Ok = false
+				check.Detail = "not attached to the bridge"
+				check.Fix = fmt.Sprintf("Attach it with: ip -n <namespace> link set %s master %s", intf, t.bridge.Attrs().Name)
+			}
+		}
+		checks = append(checks, check)
+
+		sandbox := endpoint.Sandbox
+		if sandbox == "" {
+			continue
+		}
+		check = &Check{Name: fmt.Sprintf("endpoint %s has routes to the peers", ShortId(id))}
+		checks = append(checks, check)
+		sandboxNs, err := netns.GetFromPath(sandbox)
+		if err != nil {
+			check.Detail = err.Error()
+			continue
+		}
+		sandboxNl, err := netlink.NewHandleAt(sandboxNs)
+		if err != nil {
+			sandboxNs.Close()
+			check.Detail = err.Error()
+			continue
+		}
+		present, err := sandboxNl.RouteList(nil, netlink.FAMILY_V4)
+		sandboxNl.Delete()
+		sandboxNs.Close()
+		if err != nil {
+			check.Detail = err.Error()
+			continue
+		}
+
+		missing := make([]string, 0)
+		for _, route := range routes {
+			found := false
+			for _, p := range present {
+				if p.Dst != nil && p.Dst.String() == route.Destination && p.Gw.String() == route.NextHop {
+					found = true
+				}
+			}
+			if !found {
+				missing = append(missing, route.Destination)
+			}
+		}
+		check.Ok = len(missing) == 0
+		if !check.Ok {
+			check.Detail = fmt.Sprintf("missing routes to %s", strings.Join(missing, ", "))
+			check.Fix = "Routes are only pushed when a container joins, reconnect the container to the network"
+		}
+	}
+	return checks
+}
+
+func (t *Network) peerChecks(probe bool) []*Check {
+	checks := make([]*Check, 0)
+	statuses := make(map[string]*PeerStatus)
+	for _, status := range t.PeerStatus() {
+		statuses[status.PublicKey] = status
+	}
+
+	for _, peer := range t.peers() {
+		check := &Check{Name: fmt.Sprintf("peer %s has a recent handshake", peer.PublicKey)}
+		checks = append(checks, check)
+		status, ok := statuses[peer.PublicKey]
+		if !ok {
+			check.Detail = "no status yet, the monitor may be disabled"
+			check.Ok = true
+		} else if status.Stale {
+			check.Detail = fmt.Sprintf("latest handshake %v", status.LatestHandshake)
+			if peer.Endpoint == "" {
+				check.Fix = "The peer has no endpoint configured so it has to connect to us, check its config has our endpoint and port"
+			} else {
+				check.Fix = fmt.Sprintf("Check %s is reachable and that the peer has our current public key", peer.Endpoint)
+			}
+		} else {
+			check.Ok = true
+			check.Detail = fmt.Sprintf("latest handshake %v", status.LatestHandshake)
+		}
+
+		if !probe || len(peer.AllowedIPs) == 0 {
+			continue
+		}
+		target := peer.AllowedIPs[0].IP
+		if prefix, bits := peer.AllowedIPs[0].Mask.Size(); prefix != bits {
+			target = nextIP(target.Mask(peer.AllowedIPs[0].Mask))
+		}
+		check = &Check{Name: fmt.Sprintf("ping %v through peer %s", target, peer.PublicKey)}
+		checks = append(checks, check)
+		err := inNamespace(t.ns, func() error {
+			output, err := exec.Command("ping", "-c", "1", "-W", "2", target.String()).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+			}
+			return nil
+		})
+		check.Ok = err == nil
+		if err != nil {
+			check.Detail = err.Error()
+			check.Fix = "The address may simply not answer pings, otherwise check the peer's AllowedIPs include our tunnel address"
+		}
+	}
+	return checks
+}
+
+// Walks every hop the driver set up for the network, from the forwarding rules
+// in the root namespace through to the routes inside each container.
+func (t *Network) Diagnose(probe bool, endpoints endpointTable) []*Check {
+	checks := make([]*Check, 0)
+
+	outer := net.IP(uintToBytes(bytesToUint(t.outboundAddr.To4()) - 1))
+	checks = append(checks, linkCheck(t.rootNl, "host", t.outboundIntf.Attrs().Name, outer))
+	checks = append(checks, linkCheck(t.nl, "namespace", "veth0", t.outboundAddr))
+	checks = append(checks, t.routeChecks()...)
+
+	rules, err := t.iptables.ListJumps(t.rootNs)
+	if err != nil {
+		checks = append(checks, &Check{Name: "iptables jump rules", Detail: err.Error()})
+	}
+	forwarding, err := t.iptables.ListForwarding(t.rootNs, t.outboundAddr, t.endpointAddr(), t.conf.ListenPort)
+	if err != nil {
+		checks = append(checks, &Check{Name: "iptables forwarding rules", Detail: err.Error()})
+	}
+	for _, rule := range append(rules, forwarding...) {
+		checks = append(checks, ruleCheck(rule))
+	}
+
+	for _, ns := range []struct {
+		where string
+		ns    netns.NsHandle
+	}{{"host", t.rootNs}, {"namespace", t.ns}} {
+		check := &Check{Name: fmt.Sprintf("%s forwards ipv4", ns.where)}
+		value, err := readSysctl(ns.ns, "/proc/sys/net/ipv4/ip_forward")
+		check.Ok = err == nil && value == "1"
+		if err != nil {
+			check.Detail = err.Error()
+		} else if !check.Ok {
+			check.Detail = fmt.Sprintf("net.ipv4.ip_forward = %s", value)
+			check.Fix = "Enable forwarding with: sysctl -w net.ipv4.ip_forward=1"
+			if ns.where == "namespace" {
+				check.Fix = "Enable forwarding with: ip netns exec <namespace> sysctl -w net.ipv4.ip_forward=1"
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	checks = append(checks, linkCheck(t.nl, "namespace", t.gateway.Attrs().Name, t.bridgeNet.IP))
+	checks = append(checks, linkCheck(t.nl, "namespace", t.wgInterface(), t.conf.Net.IP))
+	if t.vxlan != nil {
+		checks = append(checks, linkCheck(t.nl, "namespace", vxlanName, nil))
+	}
+	checks = append(checks, t.peerChecks(probe)...)
+	checks = append(checks, t.containerChecks(endpoints)...)
+	return checks
+}
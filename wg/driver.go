@@ -1,54 +1,211 @@
 package wg
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/vishvananda/netns"
 )
 
 type Driver struct {
+	// len(networks), readable without mu.  First for 64-bit alignment.
+	networkCount int64
+	// Set while a Responsive probe waits for mu
+	probing int32
+
+	mu       sync.Mutex
 	networks map[string]*Network
 	rootNs   netns.NsHandle
 	iptables *Iptables
+	ipam     *Ipam
+	stateDir string
+	detach   bool
+	global   bool
+	metrics  *Metrics
+	stop     chan struct{}
+
+	// Nodes of the swarm other than this one, by address, and this one's
+	self  string
+	nodes map[string]bool
 }
 
 func notSupported(method string) error {
 	return fmt.Errorf("[%v] not supported", method)
 }
 
-func logRequest(method string, request interface{}) {
-	str := spew.Sdump(request)
-	log.Printf("[%s] request: %s\n", method, str)
+// Returns a logger tagged with a fresh correlation id and the ids of whatever
+// the request refers to.
+func logRequest(method string, request interface{}) *Logger {
+	lg := logger.With("request", newRequestId(), "method", method)
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		lg.Warn("Failed to encode request", "error", err)
+		return lg
+	}
+	var ids struct {
+		NetworkID  string
+		EndpointID string
+	}
+	if json.Unmarshal(body, &ids) == nil {
+		if ids.NetworkID != "" {
+			lg = lg.With("network", ids.NetworkID)
+		}
+		if ids.EndpointID != "" {
+			lg = lg.With("endpoint", ids.EndpointID)
+		}
+	}
+	lg.Debug("Received request", "body", string(body))
+	return lg
 }
 
-func NewDriver() (*Driver, error) {
+// With the detach shutdown mode, networks are created in named namespaces so
+// that they can be left running by Detach and adopted by the next instance of
+// the driver.
+func NewDriver(conf *Config) (*Driver, error) {
+	stateDir := conf.StateDir
 	rootNs, err := netns.GetFromPid(1)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting root namespace: %v", err)
 	}
-	log.Printf("Got root namespace at fd %d\n", rootNs)
+	logger.Info("Got root namespace", "fd", int(rootNs))
 
-	iptables, err := CreateIptables()
+	states, err := LoadNetworkStates(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load network state: %v", err)
+	}
+
+	iptables, err := CreateIptables(conf, len(states) > 0)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Driver{
-		networks: make(map[string]*Network),
-		rootNs:   rootNs,
-		iptables: iptables,
-	}, nil
+	ipam, err := NewIpam(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load ipam state: %v", err)
+	}
+	nodes, err := loadNodes(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load nodes: %v", err)
+	}
+
+	networks := make(map[string]*Network)
+	for _, state := range states {
+		lg := logger.With("network", state.ID)
+		net, err := AdoptNetwork(lg, state, ipam.poolById(state.IpamPool), rootNs, iptables, stateDir)
+		if err != nil {
+			lg.Error("Failed to adopt network, tearing it down", "error", err)
+			if err = teardownNetworkState(state, rootNs, iptables, stateDir); err != nil {
+				lg.Warn("Failed to tear down network, keeping its state for the cleanup command", "error", err)
+			}
+			continue
+		}
+		networks[state.ID] = net
+	}
+
+	driver := &Driver{
+		networkCount: int64(len(networks)),
+		networks:     networks,
+		rootNs:       rootNs,
+		iptables:     iptables,
+		ipam:         ipam,
+		stateDir:     stateDir,
+		detach:       conf.Shutdown == ShutdownDetach,
+		global:       conf.Scope == ScopeGlobal,
+		metrics:      NewMetrics(),
+		stop:         make(chan struct{}),
+		self:         nodes.Self,
+		nodes:        make(map[string]bool, len(nodes.Nodes)),
+	}
+	for _, node := range nodes.Nodes {
+		driver.nodes[node] = true
+	}
+	for _, net := range networks {
+		if net.global != nil {
+			driver.addNodes(net)
+		}
+	}
+	go driver.watchEndpoints(rootNs)
+	return driver, nil
+}
+
+// The ipam driver sharing pools with the networks of this driver.
+func (t *Driver) Ipam() *Ipam {
+	return t.ipam
+}
+
+// Finds a network by its full id or by an unambiguous prefix of it, the
+// same way the docker cli does.  Returns nil if there is none.
+func (t *Driver) findNetwork(id string) (*Network, error) {
+	if net, ok := t.networks[id]; ok {
+		return net, nil
+	}
+	var found *Network
+	for netId, net := range t.networks {
+		if id != "" && strings.HasPrefix(netId, id) {
+			if found != nil {
+				return nil, fmt.Errorf("Network id %s is ambiguous", id)
+			}
+			found = net
+		}
+	}
+	return found, nil
+}
+
+// Doesn't wait for mu, which a create holds across slow wg-quick and docker
+// calls.
+func (t *Driver) NetworkCount() int {
+	return int(atomic.LoadInt64(&t.networkCount))
+}
+
+// Reports whether mu could be taken within timeout, that is whether requests
+// are still being served.  A probe left waiting by an earlier call counts as a
+// failure instead of starting another.
+func (t *Driver) Responsive(timeout time.Duration) bool {
+	if !atomic.CompareAndSwapInt32(&t.probing, 0, 1) {
+		return false
+	}
+	done := make(chan struct{})
+	go func() {
+		t.mu.Lock()
+		t.mu.Unlock()
+		atomic.StoreInt32(&t.probing, 0)
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Callers hold mu.
+func (t *Driver) countNetworks() {
+	atomic.StoreInt64(&t.networkCount, int64(len(t.networks)))
 }
 
 func (t *Driver) Delete() error {
+	close(t.stop)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	errs := make([]error, 0)
-	for _, net := range t.networks {
-		if err := net.Delete(); err != nil {
+	for id, net := range t.networks {
+		if err := t.deleteNetwork(id, net); err != nil {
 			errs = append(errs, err)
+			continue
 		}
+		delete(t.networks, id)
+		t.countNetworks()
 	}
 	if err := t.iptables.Delete(t.rootNs); err != nil {
 		errs = append(errs, err)
@@ -59,30 +216,105 @@ func (t *Driver) Delete() error {
 	return nil
 }
 
+// Stops managing all networks while leaving their namespaces, links and
+// forwarding rules in place.
+func (t *Driver) Detach() error {
+	close(t.stop)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	errs := make([]error, 0)
+	for id, net := range t.networks {
+		if !net.persistent() {
+			// Nothing else could ever adopt it
+			if err := t.deleteNetwork(id, net); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			net.log.Info("Deleted network that can't be adopted")
+		} else {
+			if err := net.Detach(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			net.log.Info("Detached network", "namespace", *net.name)
+		}
+		delete(t.networks, id)
+		t.countNetworks()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to detach: %v", errs)
+	}
+	return nil
+}
+
 func (t *Driver) GetCapabilities() (*network.CapabilitiesResponse, error) {
-	logRequest("GetCapabilities", nil)
+	lg := logRequest("GetCapabilities", nil)
 
+	scope := network.LocalScope
+	if t.global {
+		scope = network.GlobalScope
+	}
 	response := &network.CapabilitiesResponse{
-		Scope:             network.LocalScope,
-		ConnectivityScope: network.LocalScope,
+		Scope:             scope,
+		ConnectivityScope: scope,
 	}
-	log.Printf("[GetCapabilities] response: %+v\n", response)
+	lg.Debug("Responding", "scope", response.Scope, "connectivity_scope", response.ConnectivityScope)
 	return response, nil
 }
 
 func (t *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
-	logRequest("CreateNetwork", req)
+	lg := logRequest("CreateNetwork", req)
+	dockerNets := transitDockerSubnets(lg)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
 	if len(req.IPv4Data) > 1 || len(req.IPv6Data) > 0 {
 		return fmt.Errorf("Multiple ipv4 data or ipv6 data not supported")
 	}
+	if len(req.IPv4Data) == 0 {
+		return fmt.Errorf("No ipv4 data given, the network needs an ipv4 subnet")
+	}
 
-	options := req.Options["com.docker.network.generic"].(map[string]interface{})
-	network, err := CreateNetwork(req.IPv4Data[0], options, t.rootNs, t.iptables)
+	if _, ok := t.networks[req.NetworkID]; ok {
+		// Adopted from a previous instance, docker replays creation on restart
+		lg.Info("Network already exists")
+		return nil
+	}
+
+	generic := make(map[string]interface{}, 0)
+	if val, ok := req.Options[genericOptions]; ok {
+		if generic, ok = val.(map[string]interface{}); !ok {
+			return fmt.Errorf("Unexpected type %T for %s", val, genericOptions)
+		}
+	}
+	if t.global {
+		var err error
+		if generic, err = t.globalNetworkOptions(req.NetworkID, generic); err != nil {
+			return err
+		}
+	}
+	options, err := ParseNetworkOptions(GetConfig().networkOptions(generic))
+	if err != nil {
+		return err
+	}
+	if t.global {
+		if err = prepareGlobalNetwork(t.self, options); err != nil {
+			return err
+		}
+	}
+	data := req.IPv4Data[0]
+	pool := t.ipam.sharedPool(data.AddressSpace, data.Pool)
+	network, err := CreateNetwork(lg, req.NetworkID, data, options, pool, t.rootNs, t.iptables, t.stateDir, t.detach, dockerNets)
 	if err != nil {
 		return err
 	}
 	t.networks[req.NetworkID] = network
+	t.countNetworks()
+	if network.global != nil {
+		t.addNodes(network)
+	}
 
 	return nil
 }
@@ -90,35 +322,75 @@ func (t *Driver) CreateNetwork(req *network.CreateNetworkRequest) error {
 func (t *Driver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
 	logRequest("DeleteNetwork", req)
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	id := req.NetworkID
 	net := t.networks[id]
 	if net == nil {
 		return fmt.Errorf("Network %s not found\n", id)
 	}
 	delete(t.networks, id)
+	t.countNetworks()
+
+	return t.deleteNetwork(id, net)
+}
 
-	return net.Delete()
+// Deletes a network along with what the driver keeps for it outside of its
+// state.
+func (t *Driver) deleteNetwork(id string, net *Network) error {
+	if err := net.Delete(); err != nil {
+		return err
+	}
+	if net.global != nil {
+		if err := os.Remove(net.conf.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return releaseTransit(t.stateDir, id)
 }
 
+// Runs on a swarm manager, once for each global network.  The options returned
+// are what every node creates the network with.
 func (t *Driver) AllocateNetwork(req *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
-	logRequest("AllocateNetwork", req)
-	return nil, notSupported("AllocateNetwork")
+	lg := logRequest("AllocateNetwork", req)
+	if !t.global {
+		return nil, notSupported("AllocateNetwork")
+	}
+
+	options, err := allocateGlobalNetwork(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	lg.Info("Allocated global network", "tunnel_range", options["tunnel_range"], "listen_port", options["listen_port"])
+	return &network.AllocateNetworkResponse{Options: options}, nil
 }
 
+// Nothing is kept on the manager, everything is in the network's options.
 func (t *Driver) FreeNetwork(req *network.FreeNetworkRequest) error {
 	logRequest("FreeNetwork", req)
-	return notSupported("FreeNetwork")
+	if !t.global {
+		return notSupported("FreeNetwork")
+	}
+	return nil
 }
 
 func (t *Driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
-	logRequest("CreateEndpoint", req)
+	lg := logRequest("CreateEndpoint", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
 	net := t.networks[req.NetworkID]
 	if net == nil {
 		return nil, fmt.Errorf("Network %s not found", req.NetworkID)
 	}
 
-	intf, err := net.CreateEndpoint(req.EndpointID, req.Interface)
+	options, err := ParseEndpointOptions(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	intf, err := net.CreateEndpoint(lg, req.EndpointID, req.Interface, options)
 	if err != nil {
 		return nil, err
 	}
@@ -132,49 +404,142 @@ func (t *Driver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.Cr
 }
 
 func (t *Driver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
-	logRequest("DeleteEndpoint", req)
+	lg := logRequest("DeleteEndpoint", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
 	net := t.networks[req.NetworkID]
 	if net == nil {
 		return fmt.Errorf("Network %s not found", req.NetworkID)
 	}
-	return net.DeleteEndpoint(req.EndpointID)
+	return net.DeleteEndpoint(lg, req.EndpointID)
 }
 
 func (t *Driver) EndpointInfo(req *network.InfoRequest) (*network.InfoResponse, error) {
-	logRequest("EndpointInfo", req)
-	return &network.InfoResponse{Value: make(map[string]string, 0)}, nil
+	lg := logRequest("EndpointInfo", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	net := t.networks[req.NetworkID]
+	if net == nil {
+		return nil, fmt.Errorf("Network %s not found", req.NetworkID)
+	}
+
+	value, err := net.EndpointInfo(lg, req.EndpointID)
+	if err != nil {
+		return nil, err
+	}
+	return &network.InfoResponse{Value: value}, nil
 }
 
 func (t *Driver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
-	logRequest("Join", req)
+	lg := logRequest("Join", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
 	net := t.networks[req.NetworkID]
 	if net == nil {
 		return nil, fmt.Errorf("Network %s not found", req.NetworkID)
 	}
-	response, err := net.Join(req.EndpointID)
+	response, err := net.Join(lg, req.EndpointID, req.SandboxKey)
 	return response, err
 }
 
 func (t *Driver) Leave(req *network.LeaveRequest) error {
-	logRequest("Leave", req)
+	lg := logRequest("Leave", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
 	net := t.networks[req.NetworkID]
 	if net == nil {
 		return fmt.Errorf("Network %s not found", req.NetworkID)
 	}
-	return net.Leave(req.EndpointID)
+	return net.Leave(lg, req.EndpointID)
 }
 
+// Global networks peer with every node docker announces.  Other discovery
+// types are of no interest.
 func (t *Driver) DiscoverNew(req *network.DiscoveryNotification) error {
-	logRequest("DiscoverNew", req)
-	return notSupported("DiscoverNew")
+	lg := logRequest("DiscoverNew", req)
+	if !t.global {
+		return notSupported("DiscoverNew")
+	}
+	if req.DiscoveryType != nodeDiscovery {
+		return nil
+	}
+	node, err := parseNodeDiscovery(req.DiscoveryData)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if node.Self {
+		if t.self != "" && t.self != node.Address {
+			lg.Warn("Address of this node changed, existing global networks keep the old one", "previous", t.self, "address", node.Address)
+		}
+		t.self = node.Address
+	} else {
+		t.nodes[node.Address] = true
+	}
+	if err = t.saveNodes(); err != nil {
+		lg.Warn("Failed to save nodes", "error", err)
+	}
+	lg.Info("Discovered node", "node", node.Address, "self", node.Self)
+
+	if node.Self {
+		return nil
+	}
+	for _, net := range t.networks {
+		if net.global == nil {
+			continue
+		}
+		if err := net.addNode(node.IP()); err != nil {
+			net.log.Warn("Failed to add node", "node", node.Address, "error", err)
+		}
+	}
+	return nil
 }
 
 func (t *Driver) DiscoverDelete(req *network.DiscoveryNotification) error {
-	logRequest("DiscoverDelete", req)
-	return notSupported("DiscoverDelete")
+	lg := logRequest("DiscoverDelete", req)
+	if !t.global {
+		return notSupported("DiscoverDelete")
+	}
+	if req.DiscoveryType != nodeDiscovery {
+		return nil
+	}
+	node, err := parseNodeDiscovery(req.DiscoveryData)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if node.Self || !t.nodes[node.Address] {
+		return nil
+	}
+	delete(t.nodes, node.Address)
+	if err = t.saveNodes(); err != nil {
+		lg.Warn("Failed to save nodes", "error", err)
+	}
+	lg.Info("Node left", "node", node.Address)
+
+	for _, net := range t.networks {
+		if net.global == nil {
+			continue
+		}
+		if err := net.removeNode(node.IP()); err != nil {
+			net.log.Warn("Failed to remove node", "node", node.Address, "error", err)
+		}
+	}
+	return nil
 }
 
 func (t *Driver) ProgramExternalConnectivity(req *network.ProgramExternalConnectivityRequest) error {
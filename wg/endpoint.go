@@ -2,28 +2,79 @@ package wg
 
 import (
 	"crypto/rand"
+	"fmt"
 	"net"
 
 	"github.com/docker/go-plugins-helpers/network"
 )
 
+// Endpoints go from created to joined and back to left with docker's Join and
+// Leave, possibly several times, until DeleteEndpoint removes them.  Docker
+// retries calls that failed on its side and does not always leave before
+// deleting, so every transition is also accepted from the state it leads to.
+type EndpointStatus string
+
+const (
+	EndpointCreated EndpointStatus = "created"
+	EndpointJoined  EndpointStatus = "joined"
+	EndpointLeft    EndpointStatus = "left"
+)
+
 type Endpoint struct {
-	Addr *net.IPNet
-	Mac  net.HardwareAddr
+	Addr   *net.IPNet
+	Mac    net.HardwareAddr
+	Status EndpointStatus
+	// The veth end on the bridge and the sandbox it was joined to, while joined
+	Interface string
+	Sandbox   string
 }
 
-func CreateEndpoint(intf *network.EndpointInterface, ipAllocator *IpAllocator) (*Endpoint, error) {
+// Takes the address docker assigned if there is one, otherwise the reserved
+// one or the next free one.  On a shared pool the ipam driver has already
+// allocated the address.  Unless docker passes one, the mac address is random
+// or derived from the address with macFromIP.
+func CreateEndpoint(intf *network.EndpointInterface, ipAllocator *IpAllocator, reservation string, shared, macFromIp bool) (*Endpoint, error) {
 	var addr *net.IPNet
 	var mac net.HardwareAddr
 	var err error
 
-	if intf.Address != "" {
+	if shared {
+		if intf.Address == "" {
+			return nil, fmt.Errorf("No address was allocated by the ipam driver")
+		}
+		if reservation != "" {
+			return nil, fmt.Errorf("Reservations are not supported on pools of the wg ipam driver, connect with --ip")
+		}
 		var ipAddr net.IP
 		ipAddr, addr, err = net.ParseCIDR(intf.Address)
 		if err != nil {
 			return nil, err
 		}
 		addr.IP = ipAddr
+	} else if intf.Address != "" {
+		var ipAddr net.IP
+		ipAddr, addr, err = net.ParseCIDR(intf.Address)
+		if err != nil {
+			return nil, err
+		}
+		addr.IP = ipAddr
+		// Covers the wireguard address, the gateway and auxiliary addresses
+		if ipAllocator.IsUsed(ipAddr) {
+			return nil, fmt.Errorf("Address %s is already in use on this network", ipAddr)
+		}
+		name, reserved := ipAllocator.ReservedFor(ipAddr)
+		if reserved && name != reservation {
+			return nil, fmt.Errorf("Address %s is reserved for %s", ipAddr, name)
+		}
+		if reservation != "" && name != reservation {
+			return nil, fmt.Errorf("Docker assigned %s but the reservation %s is for another address, connect with --ip or use the null ipam driver", ipAddr, reservation)
+		}
+		ipAllocator.MarkUsed(ipAddr)
+	} else if reservation != "" {
+		addr, err = ipAllocator.AllocateReserved(reservation)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		addr, err = ipAllocator.FindAddress()
 		if err != nil {
@@ -36,6 +87,8 @@ func CreateEndpoint(intf *network.EndpointInterface, ipAllocator *IpAllocator) (
 		if err != nil {
 			return nil, err
 		}
+	} else if macFromIp {
+		mac = macFromIP(addr.IP)
 	} else {
 		mac = make(net.HardwareAddr, 6)
 		_, err = rand.Read(mac)
@@ -45,7 +98,120 @@ func CreateEndpoint(intf *network.EndpointInterface, ipAllocator *IpAllocator) (
 		mac[0] = (mac[0] & 0xfe) | 0x02
 	}
 
-	return &Endpoint{addr, mac}, nil
+	return &Endpoint{Addr: addr, Mac: mac, Status: EndpointCreated}, nil
+}
+
+// A repeated CreateEndpoint matches if it asks for nothing this endpoint
+// doesn't already have.
+func (t *Endpoint) matches(intf *network.EndpointInterface) bool {
+	if intf.Address != "" && intf.Address != t.Addr.String() {
+		return false
+	}
+	return intf.MacAddress == "" || intf.MacAddress == t.Mac.String()
+}
+
+// Creates and removes the veths of endpoints for the transitions below, which
+// only do the bookkeeping so that they can be tested without netlink.
+type endpointLinks interface {
+	// Returns the names of the end docker moves into the container and of
+	// the end that stays in the network namespace
+	addLink(endpoint *Endpoint) (string, string, error)
+	// Succeeds if the link is already gone
+	removeLink(endpoint *Endpoint) error
+}
+
+type endpointTable map[string]*Endpoint
+
+// A repeated create gets the existing endpoint back, allocate is only called
+// for new ones.
+func (t endpointTable) create(lg *Logger, id string, intf *network.EndpointInterface, allocate func() (*Endpoint, error)) (*Endpoint, error) {
+	if endpoint, ok := t[id]; ok {
+		if !endpoint.matches(intf) {
+			return nil, fmt.Errorf("Endpoint %s already exists with address %s", id, endpoint.Addr)
+		}
+		lg.Info("Endpoint already exists", "address", endpoint.Addr, "status", endpoint.Status)
+		return endpoint, nil
+	}
+	endpoint, err := allocate()
+	if err != nil {
+		return nil, err
+	}
+	t[id] = endpoint
+	return endpoint, nil
+}
+
+// Returns the root namespace end of the endpoint's new link.
+func (t endpointTable) join(lg *Logger, id, sandbox string, links endpointLinks) (*Endpoint, string, error) {
+	endpoint, ok := t[id]
+	if !ok {
+		return nil, "", fmt.Errorf("Endpoint %s not found", id)
+	}
+	if endpoint.Status == EndpointJoined {
+		// Docker gave up on the previous join, its veth must not linger
+		lg.Warn("Endpoint is already joined, replacing its interface", "interface", endpoint.Interface, "sandbox", endpoint.Sandbox)
+		if err := endpoint.unlink(links); err != nil {
+			return nil, "", err
+		}
+	}
+	publicName, internalName, err := links.addLink(endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	endpoint.Status = EndpointJoined
+	endpoint.Interface = internalName
+	endpoint.Sandbox = sandbox
+	return endpoint, publicName, nil
+}
+
+// Returns whether the endpoint was joined, leaving is a no-op otherwise.
+func (t endpointTable) leave(lg *Logger, id string, links endpointLinks) (bool, error) {
+	endpoint, ok := t[id]
+	if !ok {
+		return false, fmt.Errorf("Endpoint %s not found", id)
+	}
+	if endpoint.Status != EndpointJoined {
+		lg.Info("Endpoint is not joined", "status", endpoint.Status)
+		return false, nil
+	}
+	return true, endpoint.unlink(links)
+}
+
+// Returns the deleted endpoint, or nil if there was none.  Endpoints that were
+// not left are left first.
+func (t endpointTable) remove(lg *Logger, id string, links endpointLinks) (*Endpoint, error) {
+	endpoint, ok := t[id]
+	if !ok {
+		lg.Info("Endpoint already deleted")
+		return nil, nil
+	}
+	if endpoint.Status == EndpointJoined {
+		lg.Warn("Deleting endpoint that was not left", "interface", endpoint.Interface)
+		if err := endpoint.unlink(links); err != nil {
+			return nil, err
+		}
+	}
+	delete(t, id)
+	return endpoint, nil
+}
+
+// Copies the endpoints for reading without the driver lock.
+func (t endpointTable) snapshot() endpointTable {
+	endpoints := make(endpointTable, len(t))
+	for id, endpoint := range t {
+		copied := *endpoint
+		endpoints[id] = &copied
+	}
+	return endpoints
+}
+
+func (t *Endpoint) unlink(links endpointLinks) error {
+	if err := links.removeLink(t); err != nil {
+		return err
+	}
+	t.Status = EndpointLeft
+	t.Interface = ""
+	t.Sandbox = ""
+	return nil
 }
 
 func (t *Endpoint) CreateEndpointResponse() *network.EndpointInterface {
@@ -0,0 +1,172 @@
+package wg
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+// Records link changes instead of making them.
+type fakeLinks struct {
+	links     map[string]bool
+	next      int
+	removeErr error
+}
+
+func (t *fakeLinks) addLink(endpoint *Endpoint) (string, string, error) {
+	t.next++
+	name := fmt.Sprintf("veth%d", t.next)
+	t.links[name] = true
+	return "c" + name, name, nil
+}
+
+func (t *fakeLinks) removeLink(endpoint *Endpoint) error {
+	if t.removeErr != nil {
+		return t.removeErr
+	}
+	delete(t.links, endpoint.Interface)
+	return nil
+}
+
+type endpointCall struct {
+	call    string // create, join, leave or delete
+	id      string
+	address string
+	fail    bool
+}
+
+func TestEndpointTransitions(t *testing.T) {
+	tests := []struct {
+		name   string
+		calls  []endpointCall
+		status EndpointStatus // Of endpoint "a", empty if it must not exist
+		links  int
+	}{
+		{"create join leave delete", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "join", id: "a"},
+			{call: "leave", id: "a"},
+			{call: "delete", id: "a"},
+		}, "", 0},
+		{"repeated create", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "create", id: "a"},
+			{call: "create", id: "a", address: "10.0.0.2/24"},
+			{call: "create", id: "a", address: "10.0.0.3/24", fail: true},
+		}, EndpointCreated, 0},
+		{"double join", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "join", id: "a"},
+			{call: "join", id: "a"},
+		}, EndpointJoined, 1},
+		{"leave before join", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "leave", id: "a"},
+			{call: "join", id: "a"},
+		}, EndpointJoined, 1},
+		{"repeated leave", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "join", id: "a"},
+			{call: "leave", id: "a"},
+			{call: "leave", id: "a"},
+		}, EndpointLeft, 0},
+		{"rejoin after leave", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "join", id: "a"},
+			{call: "leave", id: "a"},
+			{call: "join", id: "a"},
+		}, EndpointJoined, 1},
+		{"delete while joined", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "join", id: "a"},
+			{call: "delete", id: "a"},
+		}, "", 0},
+		{"delete of an unknown id", []endpointCall{
+			{call: "create", id: "a"},
+			{call: "delete", id: "b"},
+			{call: "delete", id: "a"},
+			{call: "delete", id: "a"},
+		}, "", 0},
+		{"join and leave of an unknown id", []endpointCall{
+			{call: "join", id: "b", fail: true},
+			{call: "leave", id: "b", fail: true},
+		}, "", 0},
+	}
+	for _, test := range tests {
+		endpoints := make(endpointTable, 0)
+		links := &fakeLinks{links: make(map[string]bool, 0)}
+		allocated := 0
+		for i, c := range test.calls {
+			var err error
+			switch c.call {
+			case "create":
+				_, err = endpoints.create(logger, c.id, &network.EndpointInterface{Address: c.address}, func() (*Endpoint, error) {
+					allocated++
+					addr, _ := parseAddr("10.0.0.2/24")
+					return &Endpoint{Addr: addr, Mac: macFromIP(addr.IP), Status: EndpointCreated}, nil
+				})
+			case "join":
+				_, _, err = endpoints.join(logger, c.id, "/var/run/docker/netns/"+c.id, links)
+			case "leave":
+				_, err = endpoints.leave(logger, c.id, links)
+			case "delete":
+				_, err = endpoints.remove(logger, c.id, links)
+			}
+			if c.fail && err == nil {
+				t.Errorf("%s: call %d (%s %s) succeeded", test.name, i, c.call, c.id)
+			} else if !c.fail && err != nil {
+				t.Errorf("%s: call %d (%s %s): %v", test.name, i, c.call, c.id, err)
+			}
+		}
+
+		if allocated > 1 {
+			t.Errorf("%s: allocated %d addresses for one endpoint", test.name, allocated)
+		}
+		endpoint, ok := endpoints["a"]
+		if test.status == "" && ok {
+			t.Errorf("%s: endpoint still exists with status %s", test.name, endpoint.Status)
+		} else if test.status != "" && (!ok || endpoint.Status != test.status) {
+			t.Errorf("%s: endpoint is %v, expected status %s", test.name, endpoint, test.status)
+		}
+		if ok && (endpoint.Status == EndpointJoined) != (endpoint.Interface != "" && links.links[endpoint.Interface]) {
+			t.Errorf("%s: endpoint with status %s has interface %q", test.name, endpoint.Status, endpoint.Interface)
+		}
+		if len(links.links) != test.links {
+			t.Errorf("%s: %d links left, expected %d", test.name, len(links.links), test.links)
+		}
+	}
+}
+
+func TestEndpointLinkRemovalFailure(t *testing.T) {
+	addr, _ := parseAddr("10.0.0.2/24")
+	endpoints := endpointTable{"a": &Endpoint{Addr: addr, Mac: macFromIP(addr.IP), Status: EndpointCreated}}
+	links := &fakeLinks{links: make(map[string]bool, 0)}
+	if _, _, err := endpoints.join(logger, "a", "sandbox", links); err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoint keeps its link so that docker's retry removes it
+	links.removeErr = fmt.Errorf("Device or resource busy")
+	if _, err := endpoints.leave(logger, "a", links); err == nil {
+		t.Errorf("Leave succeeded without removing the link")
+	}
+	if _, err := endpoints.remove(logger, "a", links); err == nil {
+		t.Errorf("Delete succeeded without removing the link")
+	}
+	if _, _, err := endpoints.join(logger, "a", "sandbox", links); err == nil {
+		t.Errorf("Join succeeded without removing the old link")
+	}
+	endpoint, ok := endpoints["a"]
+	if !ok || endpoint.Status != EndpointJoined || endpoint.Interface != "veth1" {
+		t.Fatalf("Endpoint is %v after failed link removals", endpoint)
+	}
+
+	links.removeErr = nil
+	if _, err := endpoints.remove(logger, "a", links); err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 0 || len(links.links) != 0 {
+		t.Errorf("%d endpoints and %d links left after delete", len(endpoints), len(links.links))
+	}
+}
@@ -0,0 +1,332 @@
+package wg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// In global scope the swarm manager allocates a network once and every node
+// creates it from the options AllocateNetwork returned.  Nodes have no wg-quick
+// config of their own: each derives its key and tunnel address from the
+// network's secret and its own address, and those of every other node the same
+// way, so learning a node's address through discovery is enough to peer with
+// it.  Anyone holding the secret holds every node's key, so it is read from a
+// file provisioned on every node, docker shows a network's options to all of
+// its clients.
+//
+// Docker allocates container addresses from the whole subnet wherever the
+// container runs, so the nodes' bridges are joined with vxlan rather than
+// routed.  They share the gateway docker allocated as well, with the same mac
+// on every node each one answers for it to its own containers.
+
+const (
+	defaultGlobalTunnelRange = "10.254.0.0/16"
+	defaultGlobalListenPort  = "51820"
+
+	// discoverapi.NodeDiscovery
+	nodeDiscovery = 1
+)
+
+// Filled in by the manager, and by nodes for networks allocated without them.
+var globalDefaults = map[string]string{
+	"tunnel_range": defaultGlobalTunnelRange,
+	"listen_port":  defaultGlobalListenPort,
+}
+
+func globalOption(name, val string) string {
+	if val != "" {
+		return val
+	}
+	return globalDefaults[name]
+}
+
+type globalTunnel struct {
+	secret []byte
+	port   uint
+	tunnel *net.IPNet
+}
+
+func validatePort(val string) error {
+	port, err := strconv.ParseUint(val, 10, 16)
+	if err == nil && port == 0 {
+		err = fmt.Errorf("must not be 0")
+	}
+	return err
+}
+
+func readSecret(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read global secret: %v", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("Global secret in %s is not base64: %v", path, err)
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("Global secret in %s must be at least 16 bytes", path)
+	}
+	return secret, nil
+}
+
+// Fills in what the nodes need to create the network, on top of the options
+// given to docker network create.
+func allocateGlobalNetwork(options map[string]string) (map[string]string, error) {
+	allocated := make(map[string]string, len(options)+3)
+	for name, val := range options {
+		allocated[name] = val
+	}
+	if _, ok := allocated["wgconf"]; ok {
+		return nil, fmt.Errorf("Option wgconf is not supported in global scope, node configs are derived from the global secret")
+	}
+	if allocated["global_secret_file"] == "" {
+		return nil, fmt.Errorf("Option global_secret_file is required in global scope, it names a file holding the same base64 secret on every node")
+	}
+	if val, ok := allocated["vxlan"]; ok {
+		if vxlan, err := strconv.ParseBool(val); err == nil && !vxlan {
+			return nil, fmt.Errorf("Option vxlan can't be disabled in global scope, containers on different nodes only reach each other over it")
+		}
+	}
+	allocated["vxlan"] = "true"
+	for name := range globalDefaults {
+		allocated[name] = globalOption(name, allocated[name])
+		if err := findOption(NetworkOptions, name).parse(allocated[name]); err != nil {
+			return nil, err
+		}
+	}
+	return allocated, nil
+}
+
+// Returns nil for networks that are not global.
+func parseGlobalTunnel(options *Options) (*globalTunnel, error) {
+	if !options.IsSet("global_secret_file") {
+		return nil, nil
+	}
+	if !options.Bool("vxlan") {
+		return nil, fmt.Errorf("Global networks require the vxlan option")
+	}
+	secret, err := readSecret(options.String("global_secret_file"))
+	if err != nil {
+		return nil, err
+	}
+	_, tunnel, err := net.ParseCIDR(globalOption("tunnel_range", options.String("tunnel_range")))
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.ParseUint(globalOption("listen_port", options.String("listen_port")), 10, 16)
+	return &globalTunnel{secret, uint(port), tunnel}, nil
+}
+
+func (t *globalTunnel) privateKey(node net.IP) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte("wg-docker-net node key " + node.String()))
+	key := mac.Sum(nil)
+	// Clamped the way wg genkey does
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Nodes take the address at their own address' offset into the tunnel range,
+// so nodes whose addresses only differ outside of the range's host bits clash,
+// addNode refuses to peer with those.
+func (t *globalTunnel) address(node net.IP) (*net.IPNet, error) {
+	node4 := node.To4()
+	if node4 == nil {
+		return nil, fmt.Errorf("Node address %s is not an ipv4 address", node)
+	}
+	mask := bytesToUint(t.tunnel.Mask)
+	offset := bytesToUint(node4) &^ mask
+	if offset == 0 || offset == ^mask {
+		return nil, fmt.Errorf("Node address %s maps to the network or broadcast address of %s", node, t.tunnel)
+	}
+	ip := net.IP(uintToBytes(bytesToUint(t.tunnel.IP.To4()) | offset))
+	return &net.IPNet{IP: ip, Mask: t.tunnel.Mask}, nil
+}
+
+func (t *globalTunnel) peer(node net.IP) (*WgPeer, error) {
+	publicKey, err := PublicKey(t.privateKey(node))
+	if err != nil {
+		return nil, err
+	}
+	addr, err := t.address(node)
+	if err != nil {
+		return nil, err
+	}
+	return &WgPeer{
+		PublicKey:  publicKey,
+		Endpoint:   net.JoinHostPort(node.String(), fmt.Sprint(t.port)),
+		AllowedIPs: []*net.IPNet{hostNet(addr.IP)},
+	}, nil
+}
+
+func globalConfigPath(stateDir, id string) string {
+	return filepath.Join(stateDir, "global", "wg-"+ShortId(id)+".conf")
+}
+
+// Writes the wg-quick config this node brings the network's interface up with.
+func writeGlobalConfig(path string, tunnel *globalTunnel, node net.IP) error {
+	addr, err := tunnel.address(node)
+	if err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("[Interface]\nPrivateKey = %s\nListenPort = %d\nAddress = %s\n", tunnel.privateKey(node), tunnel.port, addr)
+	if err = os.MkdirAll(filepath.Dir(path), keyDirMode); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(contents), keyFileMode)
+}
+
+type NodeDiscovery struct {
+	Address     string
+	BindAddress string
+	Self        bool
+}
+
+func (t *NodeDiscovery) IP() net.IP {
+	return net.ParseIP(t.Address)
+}
+
+func parseNodeDiscovery(data interface{}) (*NodeDiscovery, error) {
+	contents, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	node := &NodeDiscovery{}
+	if err = json.Unmarshal(contents, node); err != nil {
+		return nil, fmt.Errorf("Invalid node discovery data: %v", err)
+	}
+	if net.ParseIP(node.Address) == nil {
+		return nil, fmt.Errorf("Invalid node address %q", node.Address)
+	}
+	return node, nil
+}
+
+// Nodes are remembered across restarts, docker only announces them once.
+type NodeState struct {
+	Self  string
+	Nodes []string
+}
+
+func nodesPath(stateDir string) string {
+	return filepath.Join(stateDir, "nodes.json")
+}
+
+func loadNodes(stateDir string) (*NodeState, error) {
+	state := &NodeState{}
+	contents, err := ioutil.ReadFile(nodesPath(stateDir))
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", nodesPath(stateDir), err)
+	}
+	return state, nil
+}
+
+func (t *Driver) saveNodes() error {
+	state := &NodeState{Self: t.self, Nodes: make([]string, 0, len(t.nodes))}
+	for node := range t.nodes {
+		state.Nodes = append(state.Nodes, node)
+	}
+	sort.Strings(state.Nodes)
+	return writeFileAtomic(nodesPath(t.stateDir), state)
+}
+
+// Prepares the options of a global network for this node: the wg-quick config
+// is generated and the endpoint defaults to the address docker advertises for
+// the node.
+func (t *Driver) globalNetworkOptions(id string, raw map[string]interface{}) (map[string]interface{}, error) {
+	if _, ok := raw["global_secret_file"]; !ok {
+		return nil, fmt.Errorf("Global network %s was not allocated by this driver", id)
+	}
+	if t.self == "" {
+		return nil, fmt.Errorf("The address of this node is not known yet, docker has not announced it")
+	}
+	if _, ok := raw["wgconf"]; ok {
+		return nil, fmt.Errorf("Option wgconf is not supported in global scope, node configs are derived from the global secret")
+	}
+	options := make(map[string]interface{}, len(raw)+2)
+	for name, val := range raw {
+		options[name] = val
+	}
+	options["wgconf"] = globalConfigPath(t.stateDir, id)
+	if _, ok := options["endpoint"]; !ok {
+		options["endpoint"] = t.self
+	}
+	return options, nil
+}
+
+func prepareGlobalNetwork(self string, options *Options) error {
+	tunnel, err := parseGlobalTunnel(options)
+	if err != nil {
+		return err
+	}
+	if options.Bool("rotate_key") {
+		return fmt.Errorf("Option rotate_key is not supported in global scope, node keys are derived from the global secret")
+	}
+	return writeGlobalConfig(options.String("wgconf"), tunnel, net.ParseIP(self))
+}
+
+// Peers with another node of a global network.
+func (t *Network) addNode(node net.IP) error {
+	peer, err := t.global.peer(node)
+	if err != nil {
+		return err
+	}
+	if t.hasPeer(peer.PublicKey) {
+		return nil
+	}
+	addr := peer.AllowedIPs[0]
+	if addr.IP.Equal(t.conf.Net.IP) {
+		return fmt.Errorf("Node %s has the tunnel address of this node, %s, the tunnel range must cover the bits node addresses differ in", node, addr.IP)
+	}
+	for _, other := range t.peers() {
+		for _, n := range other.AllowedIPs {
+			if n.Contains(addr.IP) {
+				return fmt.Errorf("Node %s has the tunnel address %s of peer %s, the tunnel range must cover the bits node addresses differ in", node, addr.IP, other.PublicKey)
+			}
+		}
+	}
+	if err = t.setPeer(peer); err != nil {
+		return err
+	}
+	t.log.Info("Added node", "node", node, "peer", peer.PublicKey, "address", addr)
+	return nil
+}
+
+func (t *Network) removeNode(node net.IP) error {
+	peer, err := t.global.peer(node)
+	if err != nil {
+		return err
+	}
+	if !t.hasPeer(peer.PublicKey) {
+		return nil
+	}
+	if err = t.removePeer(peer.PublicKey); err != nil {
+		return err
+	}
+	t.log.Info("Removed node", "node", node, "peer", peer.PublicKey)
+	return nil
+}
+
+// Peers a global network with every node known so far.
+func (t *Driver) addNodes(network *Network) {
+	for node := range t.nodes {
+		if err := network.addNode(net.ParseIP(node)); err != nil {
+			network.log.Warn("Failed to add node", "node", node, "error", err)
+		}
+	}
+}
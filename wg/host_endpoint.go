@@ -0,0 +1,231 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// The endpoint option is either a literal address, the name of a host
+// interface or "auto" for the source address of the default route.  Only the
+// latter two can change while the network is up.
+const (
+	endpointAuto = "auto"
+
+	endpointSettleDelay = time.Second
+)
+
+func validateEndpoint(val string) error {
+	if val == endpointAuto || net.ParseIP(val) != nil {
+		return nil
+	}
+	if len(val) > 15 || strings.ContainsAny(val, "/ \t\n") {
+		return fmt.Errorf("expected an ip address, an interface name or %s", endpointAuto)
+	}
+	return nil
+}
+
+func dynamicEndpoint(spec string) bool {
+	return net.ParseIP(spec) == nil
+}
+
+func linkAddress(rootNl *netlink.Handle, link netlink.Link) (net.IP, error) {
+	addrs, err := rootNl.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+			return addr.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("Interface %s has no global ipv4 address", link.Attrs().Name)
+}
+
+func defaultRouteAddress(rootNl *netlink.Handle) (net.IP, error) {
+	routes, err := rootNl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var best *netlink.Route
+	for i, route := range routes {
+		if !defaultRoute(route) {
+			continue
+		}
+		if best == nil || route.Priority < best.Priority {
+			best = &routes[i]
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("No default route to take the endpoint address from")
+	}
+	if best.Src != nil {
+		return best.Src, nil
+	}
+	link, err := rootNl.LinkByIndex(best.LinkIndex)
+	if err != nil {
+		return nil, err
+	}
+	return linkAddress(rootNl, link)
+}
+
+func resolveEndpoint(rootNl *netlink.Handle, spec string) (net.IP, error) {
+	if ip := net.ParseIP(spec); ip != nil {
+		return ip, nil
+	}
+	if spec == endpointAuto {
+		return defaultRouteAddress(rootNl)
+	}
+	link, err := rootNl.LinkByName(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Endpoint interface %s: %v", spec, err)
+	}
+	return linkAddress(rootNl, link)
+}
+
+func (t *Network) endpointAddr() net.IP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wgEndpoint
+}
+
+// Re-resolves a dynamic endpoint and moves the forwarding rules over if the
+// address changed, returning whether it did, even along with an error about
+// the old rules.  Runs without the driver lock, so the caller saves the state.
+func (t *Network) updateEndpoint() (bool, error) {
+	spec := t.options.String("endpoint")
+	if !dynamicEndpoint(spec) {
+		return false, nil
+	}
+
+	t.forwardingMu.Lock()
+	defer t.forwardingMu.Unlock()
+	select {
+	case <-t.stop:
+		// Deleted or detached in the meantime
+		return false, nil
+	default:
+	}
+
+	addr, err := resolveEndpoint(t.rootNl, spec)
+	if err != nil {
+		return false, err
+	}
+	previous := t.endpointAddr()
+	if addr.Equal(previous) {
+		return false, nil
+	}
+
+	// The new rules go in first so the tunnel is never left without any.
+	// The forward rules don't depend on the address, the removal takes out
+	// one of the two copies.
+	err = t.iptables.SetupForwarding(t.rootNs, t.outboundAddr, addr, t.conf.ListenPort)
+	if err != nil {
+		if removeErr := t.iptables.RemoveForwarding(t.rootNs, t.outboundAddr, addr, t.conf.ListenPort); removeErr != nil {
+			t.log.Warn("Failed to remove partially added forwarding rules", "address", addr, "error", removeErr)
+		}
+		if _, repairErr := t.iptables.RepairForwarding(t.rootNs, t.outboundAddr, previous, t.conf.ListenPort); repairErr != nil {
+			t.log.Error("Failed to restore forwarding rules", "address", previous, "error", repairErr)
+		}
+		return false, err
+	}
+	t.mu.Lock()
+	t.wgEndpoint = addr
+	t.mu.Unlock()
+
+	err = t.iptables.RemoveForwarding(t.rootNs, t.outboundAddr, previous, t.conf.ListenPort)
+	if err != nil {
+		return true, fmt.Errorf("Moved forwarding rules to %s but failed to remove those for %s: %v", addr, previous, err)
+	}
+
+	t.log.Info("Endpoint address changed, moved forwarding rules", "endpoint", spec, "previous", previous, "address", addr)
+	return true, nil
+}
+
+func defaultRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
+
+// Follows address and default route changes in the root namespace so that
+// networks with a dynamic endpoint keep receiving tunnel traffic.  Changes come
+// in bursts, not least from the driver's own links, so endpoints are only
+// re-resolved once no change came in for endpointSettleDelay.
+func (t *Driver) watchEndpoints(rootNs netns.NsHandle) {
+	addrs := make(chan netlink.AddrUpdate)
+	routes := make(chan netlink.RouteUpdate)
+	if err := netlink.AddrSubscribeAt(rootNs, addrs, t.stop); err != nil {
+		logger.Error("Failed to watch host addresses, dynamic endpoints will not be updated", "error", err)
+		return
+	}
+	if err := netlink.RouteSubscribeAt(rootNs, routes, t.stop); err != nil {
+		logger.Error("Failed to watch host routes, dynamic endpoints will not be updated", "error", err)
+		return
+	}
+
+	t.updateEndpoints()
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-t.stop:
+			return
+		case _, ok := <-addrs:
+			if !ok {
+				return
+			}
+		case update, ok := <-routes:
+			if !ok {
+				return
+			}
+			if !defaultRoute(update.Route) {
+				continue
+			}
+		case <-settle:
+			settle = nil
+			t.updateEndpoints()
+			continue
+		}
+		// Every change restarts the wait
+		settle = time.After(endpointSettleDelay)
+	}
+}
+
+// Iptables can be slow, so the rules are moved without holding mu.  Each
+// network serialises its own forwarding changes.
+func (t *Driver) updateEndpoints() {
+	t.mu.Lock()
+	networks := make(map[string]*Network, len(t.networks))
+	for id, net := range t.networks {
+		networks[id] = net
+	}
+	t.mu.Unlock()
+
+	changed := make(map[string]*Network, 0)
+	for id, net := range networks {
+		updated, err := net.updateEndpoint()
+		if err != nil {
+			net.log.Warn("Failed to update endpoint address", "endpoint", net.options.String("endpoint"), "error", err)
+		}
+		if updated {
+			changed[id] = net
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, net := range changed {
+		if t.networks[id] == net {
+			net.saveState(net.log)
+		}
+	}
+}
@@ -3,16 +3,47 @@ package wg
 import (
 	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"net"
+	"sync"
+	"time"
 )
 
+// Hands out addresses from a subnet, tracked in a bitmap indexed by the
+// offset into the subnet so pools reaching the top of the address space work.
+// Allocation moves a cursor forward and wraps around, and released addresses
+// are held back for reuseDelay so a stale arp entry or conntrack state for a
+// departed container is not inherited by the next one.
 type IpAllocator struct {
-	usedAddresses map[uint32]struct{}
-	nextAddress   uint32
-	mask          uint32
-	upperBound    uint32
+	// Allocators of pools handed out by the ipam driver are shared with the
+	// network using the pool
+	mu sync.Mutex
+
+	base uint32
+	mask uint32
+	size uint64
+
+	// Dynamic allocations are limited to offsets first..last
+	first  uint64
+	last   uint64
+	cursor uint64
+
+	used     []uint64
+	excluded []*net.IPNet
+	released map[uint64]time.Time
+
+	reserved      map[string]uint64
+	reservedNames map[uint64]string
+
+	reuseDelay time.Duration
 }
 
+const defaultReuseDelay = time.Minute
+
+// Subnets this large make no sense for a docker network and would need a
+// bitmap of hundreds of megabytes.
+const minAllocatorPrefix = 8
+
 func bytesToUint(bytes []byte) uint32 {
 	return binary.BigEndian.Uint32(bytes)
 }
@@ -23,37 +54,295 @@ func uintToBytes(val uint32) []byte {
 	return bytes
 }
 
-func CreateIpAllocator(subnet *net.IPNet) *IpAllocator {
+func CreateIpAllocator(subnet *net.IPNet) (*IpAllocator, error) {
+	if subnet.IP.To4() == nil || len(subnet.Mask) != net.IPv4len {
+		return nil, fmt.Errorf("Only ipv4 subnets are supported, got %s", subnet)
+	}
+	prefix, _ := subnet.Mask.Size()
+	if prefix < minAllocatorPrefix {
+		return nil, fmt.Errorf("Subnet %s is too large, the prefix must be at least /%d", subnet, minAllocatorPrefix)
+	}
+
 	mask := bytesToUint(subnet.Mask)
-	nextAddress := (bytesToUint(subnet.IP.To4()) & mask) + 1
-	upperBound := (nextAddress | (^mask)) + 1
-	usedAddresses := make(map[uint32]struct{}, 0)
-	return &IpAllocator{
-		usedAddresses, nextAddress, mask, upperBound,
+	size := uint64(1) << uint(32-prefix)
+	t := &IpAllocator{
+		base:          bytesToUint(subnet.IP.To4()) & mask,
+		mask:          mask,
+		size:          size,
+		first:         0,
+		last:          size - 1,
+		used:          make([]uint64, (size+63)/64),
+		released:      make(map[uint64]time.Time, 0),
+		reserved:      make(map[string]uint64, 0),
+		reservedNames: make(map[uint64]string, 0),
+		reuseDelay:    defaultReuseDelay,
+	}
+	// /31s have no network or broadcast address and a /32 is just the one
+	if size > 2 {
+		t.first = 1
+		t.last = size - 2
+	}
+	t.cursor = t.first
+	return t, nil
+}
+
+func (t *IpAllocator) offset(ip net.IP) (uint64, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	addr := bytesToUint(ip4)
+	if addr&t.mask != t.base {
+		return 0, false
+	}
+	return uint64(addr - t.base), true
+}
+
+func (t *IpAllocator) ip(offset uint64) net.IP {
+	return net.IP(uintToBytes(t.base + uint32(offset)))
+}
+
+func (t *IpAllocator) usable(offset uint64) bool {
+	return t.size <= 2 || (offset != 0 && offset != t.size-1)
+}
+
+func (t *IpAllocator) isSet(offset uint64) bool {
+	return t.used[offset/64]&(1<<(offset%64)) != 0
+}
+
+func (t *IpAllocator) set(offset uint64) {
+	t.used[offset/64] |= 1 << (offset % 64)
+}
+
+func (t *IpAllocator) clear(offset uint64) {
+	t.used[offset/64] &^= 1 << (offset % 64)
+}
+
+// Limits dynamic allocation to a part of the subnet, like docker's
+// --ip-range.  Addresses outside of it can still be used explicitly.
+func (t *IpAllocator) SetRange(r *net.IPNet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix, _ := r.Mask.Size()
+	subnetPrefix := bits.OnesCount32(t.mask)
+	start, ok := t.offset(r.IP.Mask(r.Mask))
+	if !ok || prefix < subnetPrefix {
+		return fmt.Errorf("Range %s is not inside of %s", r, &net.IPNet{IP: t.ip(0), Mask: uintToBytes(t.mask)})
+	}
+	end := start + (uint64(1) << uint(32-prefix)) - 1
+	for start < end && !t.usable(start) {
+		start++
+	}
+	for end > start && !t.usable(end) {
+		end--
+	}
+	if !t.usable(start) {
+		return fmt.Errorf("Range %s holds no usable addresses", r)
+	}
+	t.first, t.last, t.cursor = start, end, start
+	return nil
+}
+
+// Keeps a range out of dynamic allocation.
+func (t *IpAllocator) Exclude(n *net.IPNet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.excluded = append(t.excluded, n)
+}
+
+func (t *IpAllocator) isExcluded(ip net.IP) bool {
+	for _, n := range t.excluded {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets an address aside for the endpoint that asks for it by name.
+func (t *IpAllocator) Reserve(name string, ip net.IP) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offset, ok := t.offset(ip)
+	if !ok || !t.usable(offset) {
+		return fmt.Errorf("Reserved address %s=%s is not a usable address of the subnet", name, ip)
 	}
+	if other, ok := t.reservedNames[offset]; ok && other != name {
+		return fmt.Errorf("Address %s is reserved for both %s and %s", ip, other, name)
+	}
+	t.reserved[name] = offset
+	t.reservedNames[offset] = name
+	return nil
+}
+
+func (t *IpAllocator) ReservedFor(ip net.IP) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offset, ok := t.offset(ip)
+	if !ok {
+		return "", false
+	}
+	name, ok := t.reservedNames[offset]
+	return name, ok
 }
 
+func (t *IpAllocator) AllocateReserved(name string) (*net.IPNet, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offset, ok := t.reserved[name]
+	if !ok {
+		return nil, fmt.Errorf("No address is reserved for %s", name)
+	}
+	if t.isSet(offset) {
+		return nil, fmt.Errorf("Address %s reserved for %s is already in use", t.ip(offset), name)
+	}
+	t.set(offset)
+	delete(t.released, offset)
+	return &net.IPNet{IP: t.ip(offset), Mask: uintToBytes(t.mask)}, nil
+}
+
+// Addresses outside of the subnet are never used.
 func (t *IpAllocator) IsUsed(ip net.IP) bool {
-	_, ok := t.usedAddresses[bytesToUint(ip.To4())]
-	return ok
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offset, ok := t.offset(ip)
+	return ok && t.isSet(offset)
 }
 
 func (t *IpAllocator) MarkUsed(ip net.IP) {
-	t.usedAddresses[bytesToUint(ip.To4())] = struct{}{}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset, ok := t.offset(ip); ok {
+		t.set(offset)
+		delete(t.released, offset)
+	}
+}
+
+// Marks every address of a range used, as far as it overlaps the subnet.
+// Works by offset, so ranges ending at 255.255.255.255 are fine, and a word of
+// the bitmap at a time.
+func (t *IpAllocator) MarkRangeUsed(n *net.IPNet) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ip4 := n.IP.To4()
+	if ip4 == nil || len(n.Mask) != net.IPv4len {
+		return
+	}
+	mask := bytesToUint(n.Mask)
+	start := bytesToUint(ip4) & mask
+	end := start | ^mask
+	last := t.base | ^t.mask
+	if end < t.base || start > last {
+		return
+	}
+	if start < t.base {
+		start = t.base
+	}
+	if end > last {
+		end = last
+	}
+
+	from, to := uint64(start-t.base), uint64(end-t.base)
+	for offset := from; offset <= to; {
+		if offset%64 == 0 && to-offset >= 63 {
+			t.used[offset/64] = ^uint64(0)
+			offset += 64
+			continue
+		}
+		t.set(offset)
+		offset++
+	}
+	for offset := range t.released {
+		if offset >= from && offset <= to {
+			delete(t.released, offset)
+		}
+	}
 }
 
 func (t *IpAllocator) MarkUnused(ip net.IP) {
-	delete(t.usedAddresses, bytesToUint(ip.To4()))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if offset, ok := t.offset(ip); ok && t.isSet(offset) {
+		t.clear(offset)
+		t.released[offset] = time.Now()
+	}
+}
+
+// Only counts the addresses Size does, so marked ranges covering the network
+// and broadcast addresses or reaching outside of the range don't push it past
+// Size.
+func (t *IpAllocator) Used() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	used := 0
+	for offset := t.first; offset <= t.last; {
+		if offset%64 == 0 && t.last-offset >= 63 {
+			used += bits.OnesCount64(t.used[offset/64])
+			offset += 64
+			continue
+		}
+		if t.isSet(offset) {
+			used++
+		}
+		offset++
+	}
+	return used
+}
+
+// The number of addresses that can be handed out, ignoring exclusions.
+func (t *IpAllocator) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return int(t.last - t.first + 1)
+}
+
+func (t *IpAllocator) available(offset uint64, now time.Time, delayed bool) bool {
+	if t.isSet(offset) {
+		return false
+	}
+	if _, ok := t.reservedNames[offset]; ok {
+		return false
+	}
+	if t.isExcluded(t.ip(offset)) {
+		return false
+	}
+	if released, ok := t.released[offset]; ok && delayed {
+		return now.Sub(released) >= t.reuseDelay
+	}
+	return true
 }
 
 func (t *IpAllocator) FindAddress() (*net.IPNet, error) {
-	// TODO: This doesn't work if the subnet borders the top of the ipv4 address space
-	for ; t.nextAddress < t.upperBound; t.nextAddress++ {
-		if _, ok := t.usedAddresses[t.nextAddress]; !ok {
-			t.usedAddresses[t.nextAddress] = struct{}{}
-			ip := uintToBytes(t.nextAddress)
-			t.nextAddress++
-			return &net.IPNet{ip, uintToBytes(t.mask)}, nil
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	span := t.last - t.first + 1
+	// Recently released addresses are only taken if nothing else is left
+	for _, delayed := range []bool{true, false} {
+		for i := uint64(0); i < span; i++ {
+			offset := t.first + (t.cursor-t.first+i)%span
+			if !t.available(offset, now, delayed) {
+				continue
+			}
+			t.set(offset)
+			delete(t.released, offset)
+			t.cursor = offset + 1
+			if t.cursor > t.last {
+				t.cursor = t.first
+			}
+			return &net.IPNet{IP: t.ip(offset), Mask: uintToBytes(t.mask)}, nil
 		}
 	}
 	return nil, fmt.Errorf("No unused addresses remaining")
@@ -0,0 +1,280 @@
+package wg
+
+import (
+	"net"
+	"testing"
+	"testing/quick"
+)
+
+func mustAllocator(t *testing.T, cidr string) *IpAllocator {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator, err := CreateIpAllocator(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allocator
+}
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Allocates until the allocator runs out and returns what it handed out.
+func exhaust(t *testing.T, allocator *IpAllocator) []net.IP {
+	t.Helper()
+	ips := make([]net.IP, 0)
+	for {
+		addr, err := allocator.FindAddress()
+		if err != nil {
+			return ips
+		}
+		ips = append(ips, addr.IP)
+		if len(ips) > allocator.Size() {
+			t.Fatalf("Allocated %d addresses out of %d", len(ips), allocator.Size())
+		}
+	}
+}
+
+func TestIpAllocatorProperties(t *testing.T) {
+	property := func(base uint32, prefixSeed uint8, releases []uint16) bool {
+		// Small enough to exhaust quickly, /32 and /31 included
+		prefix := 22 + int(prefixSeed)%11
+		subnet := &net.IPNet{IP: net.IP(uintToBytes(base)).Mask(net.CIDRMask(prefix, 32)), Mask: net.CIDRMask(prefix, 32)}
+		allocator, err := CreateIpAllocator(subnet)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		allocator.reuseDelay = 0
+		size := uint64(1) << uint(32-prefix)
+		network := bytesToUint(subnet.IP)
+
+		check := func(ips []net.IP) bool {
+			for _, ip := range ips {
+				offset := uint64(bytesToUint(ip.To4()) - network)
+				if !subnet.Contains(ip) {
+					t.Logf("%s is outside of %s", ip, subnet)
+					return false
+				}
+				if size > 2 && (offset == 0 || offset == size-1) {
+					t.Logf("%s is the network or broadcast address of %s", ip, subnet)
+					return false
+				}
+			}
+			return true
+		}
+
+		ips := exhaust(t, allocator)
+		if len(ips) != allocator.Size() || allocator.Used() != len(ips) {
+			t.Logf("Allocated %d addresses of %s, expected %d", len(ips), subnet, allocator.Size())
+			return false
+		}
+		if !check(ips) {
+			return false
+		}
+
+		// Releasing some makes exactly those available again
+		released := make(map[string]bool, 0)
+		for _, r := range releases {
+			ip := ips[int(r)%len(ips)]
+			allocator.MarkUnused(ip)
+			released[ip.String()] = true
+		}
+		again := exhaust(t, allocator)
+		if len(again) != len(released) || !check(again) {
+			t.Logf("Reallocated %d addresses after releasing %d", len(again), len(released))
+			return false
+		}
+		for _, ip := range again {
+			if !released[ip.String()] {
+				t.Logf("Reallocated %s, which was never released", ip)
+				return false
+			}
+			delete(released, ip.String())
+		}
+		return true
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIpAllocatorWrapsAround(t *testing.T) {
+	allocator := mustAllocator(t, "10.0.0.0/29")
+	allocator.reuseDelay = 0
+	ips := exhaust(t, allocator)
+	if len(ips) != 6 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[5].Equal(net.ParseIP("10.0.0.6")) {
+		t.Fatalf("Allocated %v from 10.0.0.0/29", ips)
+	}
+
+	allocator.MarkUnused(net.ParseIP("10.0.0.2"))
+	allocator.MarkUnused(net.ParseIP("10.0.0.5"))
+	for _, want := range []string{"10.0.0.2", "10.0.0.5"} {
+		addr, err := allocator.FindAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.IP.Equal(net.ParseIP(want)) {
+			t.Errorf("Allocated %s after wrapping around, expected %s", addr.IP, want)
+		}
+	}
+}
+
+func TestIpAllocatorReuseDelay(t *testing.T) {
+	allocator := mustAllocator(t, "10.0.0.0/29")
+	first, _ := allocator.FindAddress()
+	allocator.MarkUnused(first.IP)
+
+	// Every other address goes before the one just released
+	ips := exhaust(t, allocator)
+	if len(ips) != 6 {
+		t.Fatalf("Allocated %d addresses, expected 6", len(ips))
+	}
+	if !ips[5].Equal(first.IP) {
+		t.Errorf("Released address %s was handed out before the others: %v", first.IP, ips)
+	}
+
+	allocator.MarkUnused(first.IP)
+	allocator.MarkUsed(first.IP)
+	if _, err := allocator.FindAddress(); err == nil {
+		t.Errorf("Address marked used again was handed out")
+	}
+}
+
+func TestIpAllocatorSetRange(t *testing.T) {
+	tests := []struct {
+		subnet string
+		r      string
+		want   []string
+		fail   bool
+	}{
+		{"10.0.0.0/24", "10.0.0.0/24", []string{"10.0.0.1", "10.0.0.254"}, false},
+		{"10.0.0.0/24", "10.0.0.128/25", []string{"10.0.0.128", "10.0.0.254"}, false},
+		{"10.0.0.0/24", "10.0.0.0/30", []string{"10.0.0.1", "10.0.0.3"}, false},
+		{"10.0.0.0/24", "10.0.0.254/31", []string{"10.0.0.254", "10.0.0.254"}, false},
+		{"10.0.0.0/24", "10.0.0.7/32", []string{"10.0.0.7", "10.0.0.7"}, false},
+		{"10.0.0.0/24", "10.0.0.0/32", nil, true},
+		{"10.0.0.0/24", "10.0.0.255/32", nil, true},
+		{"10.0.0.0/24", "10.0.0.0/23", nil, true},
+		{"10.0.0.0/24", "10.0.1.0/28", nil, true},
+		{"10.0.0.0/31", "10.0.0.0/32", []string{"10.0.0.0", "10.0.0.0"}, false},
+	}
+	for _, test := range tests {
+		allocator := mustAllocator(t, test.subnet)
+		err := allocator.SetRange(mustCIDR(t, test.r))
+		if test.fail {
+			if err == nil {
+				t.Errorf("SetRange(%s) on %s succeeded", test.r, test.subnet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SetRange(%s) on %s: %v", test.r, test.subnet, err)
+			continue
+		}
+		ips := exhaust(t, allocator)
+		if len(ips) == 0 || !ips[0].Equal(net.ParseIP(test.want[0])) || !ips[len(ips)-1].Equal(net.ParseIP(test.want[1])) {
+			t.Errorf("SetRange(%s) on %s allocated %v, expected %s to %s", test.r, test.subnet, ips, test.want[0], test.want[1])
+		}
+	}
+}
+
+func TestIpAllocatorReservations(t *testing.T) {
+	allocator := mustAllocator(t, "10.0.0.0/29")
+	if err := allocator.Reserve("web", net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.7", "10.0.1.1"} {
+		if err := allocator.Reserve("other", net.ParseIP(ip)); err == nil {
+			t.Errorf("Reserved unusable address %s", ip)
+		}
+	}
+	if err := allocator.Reserve("db", net.ParseIP("10.0.0.3")); err == nil {
+		t.Errorf("Reserved 10.0.0.3 for a second name")
+	}
+
+	for _, ip := range exhaust(t, allocator) {
+		if ip.Equal(net.ParseIP("10.0.0.3")) {
+			t.Errorf("Reserved address was allocated dynamically")
+		}
+	}
+	if name, ok := allocator.ReservedFor(net.ParseIP("10.0.0.3")); !ok || name != "web" {
+		t.Errorf("10.0.0.3 is reserved for %q, expected web", name)
+	}
+	addr, err := allocator.AllocateReserved("web")
+	if err != nil || !addr.IP.Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("AllocateReserved returned %v, %v", addr, err)
+	}
+	if _, err = allocator.AllocateReserved("web"); err == nil {
+		t.Errorf("Reserved address was allocated twice")
+	}
+	if _, err = allocator.AllocateReserved("db"); err == nil {
+		t.Errorf("Allocated a reservation that does not exist")
+	}
+}
+
+func TestIpAllocatorTopOfAddressSpace(t *testing.T) {
+	tests := []struct {
+		subnet      string
+		first, last string
+		count       int
+	}{
+		{"255.255.255.0/24", "255.255.255.1", "255.255.255.254", 254},
+		{"255.255.255.252/30", "255.255.255.253", "255.255.255.254", 2},
+		{"255.255.255.254/31", "255.255.255.254", "255.255.255.255", 2},
+		{"255.255.255.255/32", "255.255.255.255", "255.255.255.255", 1},
+	}
+	for _, test := range tests {
+		allocator := mustAllocator(t, test.subnet)
+		ips := exhaust(t, allocator)
+		if len(ips) != test.count || !ips[0].Equal(net.ParseIP(test.first)) || !ips[len(ips)-1].Equal(net.ParseIP(test.last)) {
+			t.Errorf("Allocated %v from %s, expected %d addresses from %s to %s", ips, test.subnet, test.count, test.first, test.last)
+		}
+		if allocator.IsUsed(net.ParseIP("0.0.0.0")) {
+			t.Errorf("Allocation in %s wrapped to 0.0.0.0", test.subnet)
+		}
+	}
+}
+
+func TestIpAllocatorMarkRangeUsed(t *testing.T) {
+	tests := []struct {
+		subnet string
+		r      string
+		used   int
+	}{
+		{"10.0.0.0/24", "10.0.0.64/26", 64},
+		{"10.0.0.0/24", "10.0.0.5/32", 1},
+		{"10.0.0.0/24", "10.0.0.0/16", 254},
+		{"10.0.0.0/24", "10.0.1.0/24", 0},
+		{"10.0.0.0/16", "10.0.1.32/27", 32},
+		{"10.0.0.0/16", "10.0.0.0/17", 32767},
+		{"255.255.255.0/24", "255.255.255.128/25", 127},
+		{"255.255.255.0/24", "255.255.255.255/32", 0},
+		{"10.0.0.0/31", "10.0.0.0/24", 2},
+	}
+	for _, test := range tests {
+		allocator := mustAllocator(t, test.subnet)
+		// Addresses already in use are not counted twice
+		allocator.MarkUsed(mustCIDR(t, test.r).IP)
+		allocator.MarkRangeUsed(mustCIDR(t, test.r))
+		if used := allocator.Used(); used != test.used || used > allocator.Size() {
+			t.Errorf("Marking %s in %s used %d addresses of %d, expected %d", test.r, test.subnet, used, allocator.Size(), test.used)
+		}
+	}
+
+	allocator := mustAllocator(t, "255.255.255.0/24")
+	allocator.MarkRangeUsed(mustCIDR(t, "255.255.255.128/25"))
+	ips := exhaust(t, allocator)
+	if len(ips) != 127 || !ips[len(ips)-1].Equal(net.ParseIP("255.255.255.127")) {
+		t.Errorf("Allocated %d addresses up to %s next to a marked range", len(ips), ips[len(ips)-1])
+	}
+}
@@ -0,0 +1,392 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/ipam"
+)
+
+// Docker's ipam api, served next to the network driver.  A network created on
+// a pool from here shares the pool's allocator, so the wireguard address,
+// peers' addresses and the bridge are never handed to containers.
+
+const (
+	IpamLocalAddressSpace  = "WgLocal"
+	IpamGlobalAddressSpace = "WgGlobal"
+)
+
+var IpamOptions = []*Option{
+	{Name: "wgconf", Type: OptionPath, Description: "wg-quick config of the network, its address and addresses routed to peers are kept out of the pool"},
+	{Name: "exclude", Type: OptionString, Description: "comma separated addresses or ranges never to allocate", Validate: validateAddressList},
+	{Name: "reuse_delay", Type: OptionDuration, Default: defaultReuseDelay.String(), Description: "time a released address is held back before being allocated again"},
+}
+
+type IpamPoolState struct {
+	ID           string
+	AddressSpace string
+	Pool         string
+	SubPool      string            `json:",omitempty"`
+	Options      map[string]string `json:",omitempty"`
+	Addresses    []string
+}
+
+type ipamPool struct {
+	id           string
+	addressSpace string
+	pool         *net.IPNet
+	subPool      string
+	options      map[string]string
+	allocator    *IpAllocator
+	// Addresses handed out through the api, as opposed to ones the network
+	// marked used itself
+	addresses map[string]bool
+	// Loaded from the state directory and not yet requested again
+	adopted bool
+}
+
+type Ipam struct {
+	mu       sync.Mutex
+	stateDir string
+	pools    map[string]*ipamPool
+}
+
+func ipamPath(stateDir string) string {
+	return filepath.Join(stateDir, "ipam.json")
+}
+
+func NewIpam(stateDir string) (*Ipam, error) {
+	t := &Ipam{
+		stateDir: stateDir,
+		pools:    make(map[string]*ipamPool, 0),
+	}
+	contents, err := ioutil.ReadFile(ipamPath(stateDir))
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var states []*IpamPoolState
+	if err = json.Unmarshal(contents, &states); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", ipamPath(stateDir), err)
+	}
+	for _, state := range states {
+		pool, err := createIpamPool(state.AddressSpace, state.Pool, state.SubPool, state.Options)
+		if err != nil {
+			logger.Error("Failed to restore ipam pool, dropping it", "pool", state.ID, "error", err)
+			continue
+		}
+		for _, str := range state.Addresses {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				logger.Warn("Ignoring invalid address in ipam state", "pool", state.ID, "address", str)
+				continue
+			}
+			pool.allocator.MarkUsed(ip)
+			pool.addresses[ip.String()] = true
+		}
+		pool.adopted = true
+		t.pools[pool.id] = pool
+	}
+	return t, nil
+}
+
+func (t *Ipam) save() error {
+	states := make([]*IpamPoolState, 0, len(t.pools))
+	for _, pool := range t.pools {
+		addresses := make([]string, 0, len(pool.addresses))
+		for addr := range pool.addresses {
+			addresses = append(addresses, addr)
+		}
+		states = append(states, &IpamPoolState{
+			ID:           pool.id,
+			AddressSpace: pool.addressSpace,
+			Pool:         pool.pool.String(),
+			SubPool:      pool.subPool,
+			Options:      pool.options,
+			Addresses:    addresses,
+		})
+	}
+	return writeFileAtomic(ipamPath(t.stateDir), states)
+}
+
+func ipamPoolId(addressSpace string, pool *net.IPNet, subPool string) string {
+	id := addressSpace + "/" + pool.String()
+	if subPool != "" {
+		id += "/" + subPool
+	}
+	return id
+}
+
+func createIpamPool(addressSpace, poolStr, subPool string, raw map[string]string) (*ipamPool, error) {
+	_, pool, err := net.ParseCIDR(poolStr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pool %q: %v", poolStr, err)
+	}
+	values := make(map[string]interface{}, len(raw))
+	for name, val := range raw {
+		values[name] = val
+	}
+	options, err := parseOptions("ipam", IpamOptions, values)
+	if err != nil {
+		return nil, err
+	}
+
+	allocator, err := CreateIpAllocator(pool)
+	if err != nil {
+		return nil, err
+	}
+	allocator.reuseDelay = options.Duration("reuse_delay")
+	if subPool != "" {
+		_, r, err := net.ParseCIDR(subPool)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid sub pool %q: %v", subPool, err)
+		}
+		if err = allocator.SetRange(r); err != nil {
+			return nil, err
+		}
+	}
+	if options.IsSet("exclude") {
+		excluded, _ := parseAddressList(options.String("exclude"))
+		for _, n := range excluded {
+			allocator.Exclude(n)
+		}
+	}
+	if options.IsSet("wgconf") {
+		conf, err := ParseWgConfig(options.String("wgconf"))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse wireguard config %s: %v", options.String("wgconf"), err)
+		}
+		allocator.MarkUsed(conf.Net.IP)
+		markPeerAddresses(allocator, pool, conf.Peers)
+	}
+
+	return &ipamPool{
+		id:           ipamPoolId(addressSpace, pool, subPool),
+		addressSpace: addressSpace,
+		pool:         pool,
+		subPool:      subPool,
+		options:      raw,
+		allocator:    allocator,
+		addresses:    make(map[string]bool, 0),
+	}, nil
+}
+
+// Marks the addresses routed to peers inside of subnet as used.  A peer
+// routing all of subnet or more (a hub) doesn't use every address in it, only
+// the more specific ones count.
+func markPeerAddresses(allocator *IpAllocator, subnet *net.IPNet, peers []*WgPeer) {
+	subnetPrefix, _ := subnet.Mask.Size()
+	for _, peer := range peers {
+		for _, allowed := range peer.AllowedIPs {
+			if prefix, _ := allowed.Mask.Size(); prefix <= subnetPrefix {
+				continue
+			}
+			allocator.MarkRangeUsed(allowed)
+		}
+	}
+}
+
+func (t *Ipam) findPool(id string) (*ipamPool, error) {
+	pool, ok := t.pools[id]
+	if !ok {
+		return nil, fmt.Errorf("Pool %s not found", id)
+	}
+	return pool, nil
+}
+
+// The pool a network with this ipam data was created on, if it came from
+// here.
+func (t *Ipam) sharedPool(addressSpace, poolStr string) *ipamPool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, pool := range t.pools {
+		if pool.addressSpace == addressSpace && pool.pool.String() == poolStr {
+			return pool
+		}
+	}
+	return nil
+}
+
+func (t *Ipam) poolById(id string) *ipamPool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pools[id]
+}
+
+func (t *Ipam) GetCapabilities() (*ipam.CapabilitiesResponse, error) {
+	logRequest("IpamGetCapabilities", nil)
+	return &ipam.CapabilitiesResponse{RequiresMACAddress: false}, nil
+}
+
+func (t *Ipam) GetDefaultAddressSpaces() (*ipam.AddressSpacesResponse, error) {
+	logRequest("GetDefaultAddressSpaces", nil)
+	return &ipam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  IpamLocalAddressSpace,
+		GlobalDefaultAddressSpace: IpamGlobalAddressSpace,
+	}, nil
+}
+
+func (t *Ipam) RequestPool(req *ipam.RequestPoolRequest) (*ipam.RequestPoolResponse, error) {
+	lg := logRequest("RequestPool", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if req.V6 {
+		return nil, fmt.Errorf("Ipv6 pools are not supported")
+	}
+	if req.Pool == "" {
+		return nil, fmt.Errorf("A subnet is required, pass --subnet to docker network create")
+	}
+	pool, err := createIpamPool(req.AddressSpace, req.Pool, req.SubPool, req.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, ok := t.pools[pool.id]; ok && existing.adopted {
+		// Docker asks again for the pools of networks it restores
+		existing.adopted = false
+		lg.Info("Pool already exists", "pool", existing.id)
+		return &ipam.RequestPoolResponse{PoolID: existing.id, Pool: existing.pool.String()}, nil
+	}
+	for _, other := range t.pools {
+		if other.addressSpace == pool.addressSpace && overlaps(other.pool, pool.pool) {
+			return nil, fmt.Errorf("Pool %s overlaps with %s", pool.pool, other.id)
+		}
+	}
+
+	t.pools[pool.id] = pool
+	if err = t.save(); err != nil {
+		delete(t.pools, pool.id)
+		return nil, err
+	}
+	lg.Info("Allocated pool", "pool", pool.id)
+	return &ipam.RequestPoolResponse{PoolID: pool.id, Pool: pool.pool.String()}, nil
+}
+
+func (t *Ipam) ReleasePool(req *ipam.ReleasePoolRequest) error {
+	lg := logRequest("ReleasePool", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pool, err := t.findPool(req.PoolID)
+	if err != nil {
+		return err
+	}
+	delete(t.pools, pool.id)
+	if err = t.save(); err != nil {
+		t.pools[pool.id] = pool
+		return err
+	}
+	lg.Info("Released pool", "pool", pool.id)
+	return nil
+}
+
+func (t *Ipam) RequestAddress(req *ipam.RequestAddressRequest) (*ipam.RequestAddressResponse, error) {
+	lg := logRequest("RequestAddress", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pool, err := t.findPool(req.PoolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	if req.Address != "" {
+		ip = net.ParseIP(req.Address)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address %q", req.Address)
+		}
+		if !pool.pool.Contains(ip) {
+			return nil, fmt.Errorf("Address %s is outside of the pool %s", ip, pool.pool)
+		}
+		// Covers the wireguard address and peers' addresses as well
+		if pool.allocator.IsUsed(ip) {
+			return nil, fmt.Errorf("Address %s is already in use", ip)
+		}
+		pool.allocator.MarkUsed(ip)
+	} else {
+		addr, err := pool.allocator.FindAddress()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to allocate address from %s: %v", pool.id, err)
+		}
+		ip = addr.IP
+	}
+
+	pool.addresses[ip.String()] = true
+	if err = t.save(); err != nil {
+		delete(pool.addresses, ip.String())
+		pool.allocator.MarkUnused(ip)
+		return nil, err
+	}
+	addr := &net.IPNet{IP: ip, Mask: pool.pool.Mask}
+	lg.Info("Allocated address", "pool", pool.id, "address", addr)
+	return &ipam.RequestAddressResponse{Address: addr.String()}, nil
+}
+
+func (t *Ipam) ReleaseAddress(req *ipam.ReleaseAddressRequest) error {
+	lg := logRequest("ReleaseAddress", req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pool, err := t.findPool(req.PoolID)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(req.Address)
+	if ip == nil {
+		return fmt.Errorf("Invalid address %q", req.Address)
+	}
+	if !pool.addresses[ip.String()] {
+		return fmt.Errorf("Address %s was not allocated from %s", ip, pool.id)
+	}
+
+	delete(pool.addresses, ip.String())
+	pool.allocator.MarkUnused(ip)
+	lg.Info("Released address", "pool", pool.id, "address", ip)
+	return t.save()
+}
+
+// Checks that a network on a shared pool leaves allocation to the pool and
+// keeps its wireguard address and peers' addresses out of it.
+func (t *ipamPool) claimNetwork(subnet *net.IPNet, conf *WgConfig, options *Options) error {
+	if options.IsSet("ip_range") {
+		return fmt.Errorf("Option ip_range is not supported on pools of the wg ipam driver, give the range with --ip-range")
+	}
+	if options.IsSet("exclude") {
+		return fmt.Errorf("Option exclude is not supported on pools of the wg ipam driver, pass it with --ipam-opt exclude=...")
+	}
+	if options.IsSet("reservations") {
+		return fmt.Errorf("Option reservations is not supported on pools of the wg ipam driver, which has no reservations")
+	}
+	if subnet.Contains(conf.Net.IP) && t.allocator.IsUsed(conf.Net.IP) && !t.usesWgConf(conf.Path) {
+		return fmt.Errorf("Wireguard address %s was already handed out by the ipam driver, pass --ipam-opt wgconf=%s", conf.Net.IP, conf.Path)
+	}
+	t.allocator.MarkUsed(conf.Net.IP)
+	markPeerAddresses(t.allocator, subnet, conf.Peers)
+	return nil
+}
+
+// The part of the pool given with --ip-range, nil if there is none.
+func (t *ipamPool) subRange() *net.IPNet {
+	if t.subPool == "" {
+		return nil
+	}
+	_, r, _ := net.ParseCIDR(t.subPool)
+	return r
+}
+
+func (t *ipamPool) usesWgConf(path string) bool {
+	return t.options["wgconf"] == path
+}
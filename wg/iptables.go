@@ -2,7 +2,6 @@ package wg
 
 import (
 	"net"
-	"runtime"
 	"strconv"
 
 	"github.com/coreos/go-iptables/iptables"
@@ -13,16 +12,10 @@ const (
 	nat    = "nat"
 	filter = "filter"
 
-	chain_prefix = "WG-DOCKER-"
-
 	source_pre     = "PREROUTING"
 	source_post    = "POSTROUTING"
 	source_forward = "FORWARD"
 
-	pre     = chain_prefix + source_pre
-	post    = chain_prefix + source_post
-	forward = chain_prefix + source_forward
-
 	jump  = "-j"
 	proto = "-p"
 	udp   = "udp"
@@ -30,19 +23,28 @@ const (
 
 type Iptables struct {
 	i *iptables.IPTables
+
+	// With the none backend the host firewall is left to the administrator
+	disabled bool
+
+	pre     string
+	post    string
+	forward string
 }
 
 func jumpRule(target string) []string {
 	return []string{jump, target, proto, udp}
 }
 
-func (i *Iptables) createOrClearChain(table, sourceChain, chain string) error {
+func (i *Iptables) createOrClearChain(table, sourceChain, chain string, keep bool) error {
 	exists, err := i.i.ChainExists(table, chain)
 	if err != nil {
 		return err
 	}
 
-	if exists {
+	if exists && keep {
+		return i.i.AppendUnique(table, sourceChain, jumpRule(chain)...)
+	} else if exists {
 		err = i.i.ClearChain(table, chain)
 	} else {
 		err = i.i.NewChain(table, chain)
@@ -71,20 +73,31 @@ func (i *Iptables) deleteChain(table, sourceChain, chain string) error {
 	return nil
 }
 
-func CreateIptables() (*Iptables, error) {
+// Existing chains are cleared unless keep is set, in which case the rules of
+// networks adopted from a previous instance stay in place.
+func CreateIptables(conf *Config, keep bool) (*Iptables, error) {
 	iptables, err := iptables.New()
 	if err != nil {
 		return nil, err
 	}
-	i := &Iptables{iptables}
+	i := &Iptables{
+		i:        iptables,
+		disabled: conf.Firewall == FirewallNone,
+		pre:      conf.ChainPrefix + source_pre,
+		post:     conf.ChainPrefix + source_post,
+		forward:  conf.ChainPrefix + source_forward,
+	}
+	if i.disabled {
+		return i, nil
+	}
 
-	if err = i.createOrClearChain(nat, source_pre, pre); err != nil {
+	if err = i.createOrClearChain(nat, source_pre, i.pre, keep); err != nil {
 		return nil, err
 	}
-	if err = i.createOrClearChain(nat, source_post, post); err != nil {
+	if err = i.createOrClearChain(nat, source_post, i.post, keep); err != nil {
 		return nil, err
 	}
-	if err = i.createOrClearChain(filter, source_forward, forward); err != nil {
+	if err = i.createOrClearChain(filter, source_forward, i.forward, keep); err != nil {
 		return nil, err
 	}
 
@@ -92,33 +105,19 @@ func CreateIptables() (*Iptables, error) {
 }
 
 func (i *Iptables) Delete(ns netns.NsHandle) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	currentNs, err := netns.Get()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		netns.Set(currentNs)
-		_ = currentNs.Close()
-	}()
-
-	err = netns.Set(ns)
-	if err != nil {
-		return err
+	if i.disabled {
+		return nil
 	}
 
-	if err := i.deleteChain(nat, source_pre, pre); err != nil {
-		return err
-	}
-	if err := i.deleteChain(nat, source_post, post); err != nil {
-		return err
-	}
-	if err := i.deleteChain(filter, source_forward, forward); err != nil {
-		return err
-	}
-	return nil
+	return inNamespace(ns, func() error {
+		if err := i.deleteChain(nat, source_pre, i.pre); err != nil {
+			return err
+		}
+		if err := i.deleteChain(nat, source_post, i.post); err != nil {
+			return err
+		}
+		return i.deleteChain(filter, source_forward, i.forward)
+	})
 }
 
 func snatRule(source, endpoint net.IP, port uint) []string {
@@ -138,67 +137,144 @@ func forwardInRule(source net.IP, port uint) []string {
 }
 
 func (i *Iptables) SetupForwarding(ns netns.NsHandle, source, endpoint net.IP, port uint) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	currentNs, err := netns.Get()
-	if err != nil {
-		return err
+	if i.disabled {
+		return nil
 	}
-	defer func() {
-		netns.Set(currentNs)
-		_ = currentNs.Close()
-	}()
 
-	err = netns.Set(ns)
-	if err != nil {
-		return err
-	}
+	return inNamespace(ns, func() error {
+		if err := i.i.Insert(nat, i.pre, 1, dnatRule(source, endpoint, port)...); err != nil {
+			return err
+		}
+		if err := i.i.Insert(nat, i.post, 1, snatRule(source, endpoint, port)...); err != nil {
+			return err
+		}
+		if err := i.i.Insert(filter, i.forward, 1, forwardOutRule(source, port)...); err != nil {
+			return err
+		}
+		return i.i.Insert(filter, i.forward, 1, forwardInRule(source, port)...)
+	})
+}
 
-	if err := i.i.Insert(nat, pre, 1, dnatRule(source, endpoint, port)...); err != nil {
-		return err
+type IptablesRule struct {
+	Table   string
+	Chain   string
+	Rule    []string
+	Present bool
+}
+
+func (i *Iptables) forwardingRules(source, endpoint net.IP, port uint) []*IptablesRule {
+	return []*IptablesRule{
+		{nat, i.pre, dnatRule(source, endpoint, port), false},
+		{nat, i.post, snatRule(source, endpoint, port), false},
+		{filter, i.forward, forwardOutRule(source, port), false},
+		{filter, i.forward, forwardInRule(source, port), false},
 	}
-	if err := i.i.Insert(nat, post, 1, snatRule(source, endpoint, port)...); err != nil {
-		return err
+}
+
+// Lists the forwarding rules for a network along with whether they are
+// actually installed.
+func (i *Iptables) ListForwarding(ns netns.NsHandle, source, endpoint net.IP, port uint) ([]*IptablesRule, error) {
+	rules := i.forwardingRules(source, endpoint, port)
+	if i.disabled {
+		return rules, nil
 	}
-	if err := i.i.Insert(filter, forward, 1, forwardOutRule(source, port)...); err != nil {
-		return err
+	err := inNamespace(ns, func() error {
+		for _, r := range rules {
+			var err error
+			if r.Present, err = i.i.Exists(r.Table, r.Chain, r.Rule...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if err := i.i.Insert(filter, forward, 1, forwardInRule(source, port)...); err != nil {
-		return err
+	return rules, nil
+}
+
+// Re-inserts any forwarding rules that went missing, for example because
+// something else flushed the chains, and returns how many were restored.
+func (i *Iptables) RepairForwarding(ns netns.NsHandle, source, endpoint net.IP, port uint) (int, error) {
+	if i.disabled {
+		return 0, nil
 	}
-	return nil
+
+	repaired := 0
+	err := inNamespace(ns, func() error {
+		for _, r := range i.forwardingRules(source, endpoint, port) {
+			exists, err := i.i.Exists(r.Table, r.Chain, r.Rule...)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if err := i.i.Insert(r.Table, r.Chain, 1, r.Rule...); err != nil {
+				return err
+			}
+			repaired++
+		}
+		return nil
+	})
+	return repaired, err
 }
 
 func (i *Iptables) RemoveForwarding(ns netns.NsHandle, source, endpoint net.IP, port uint) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	currentNs, err := netns.Get()
-	if err != nil {
-		return err
+	if i.disabled {
+		return nil
 	}
-	defer func() {
-		netns.Set(currentNs)
-		_ = currentNs.Close()
-	}()
 
-	err = netns.Set(ns)
-	if err != nil {
-		return err
-	}
+	return inNamespace(ns, func() error {
+		if err := i.i.DeleteIfExists(nat, i.pre, dnatRule(source, endpoint, port)...); err != nil {
+			return err
+		}
+		if err := i.i.DeleteIfExists(nat, i.post, snatRule(source, endpoint, port)...); err != nil {
+			return err
+		}
+		if err := i.i.DeleteIfExists(filter, i.forward, forwardOutRule(source, port)...); err != nil {
+			return err
+		}
+		return i.i.DeleteIfExists(filter, i.forward, forwardInRule(source, port)...)
+	})
+}
 
-	if err := i.i.DeleteIfExists(nat, pre, dnatRule(source, endpoint, port)...); err != nil {
-		return err
-	}
-	if err := i.i.DeleteIfExists(nat, post, snatRule(source, endpoint, port)...); err != nil {
-		return err
-	}
-	if err := i.i.DeleteIfExists(filter, forward, forwardOutRule(source, port)...); err != nil {
-		return err
+func masqueradeRule(subnet *net.IPNet, outIntf string) []string {
+	return []string{jump, "MASQUERADE", "--source", subnet.String(), "--out-interface", outIntf}
+}
+
+// Hides the container subnet behind the tunnel address, run in the network's
+// own namespace so it goes away along with the namespace.
+func (i *Iptables) SetupMasquerade(ns netns.NsHandle, subnet *net.IPNet, outIntf string) error {
+	return inNamespace(ns, func() error {
+		return i.i.AppendUnique(nat, source_post, masqueradeRule(subnet, outIntf)...)
+	})
+}
+
+func (i *Iptables) RemoveMasquerade(ns netns.NsHandle, subnet *net.IPNet, outIntf string) error {
+	return inNamespace(ns, func() error {
+		return i.i.DeleteIfExists(nat, source_post, masqueradeRule(subnet, outIntf)...)
+	})
+}
+
+// Checks that the driver's chains are still hooked into the builtin ones.
+func (i *Iptables) ListJumps(ns netns.NsHandle) ([]*IptablesRule, error) {
+	rules := []*IptablesRule{
+		{nat, source_pre, jumpRule(i.pre), false},
+		{nat, source_post, jumpRule(i.post), false},
+		{filter, source_forward, jumpRule(i.forward), false},
 	}
-	if err := i.i.DeleteIfExists(filter, forward, forwardInRule(source, port)...); err != nil {
-		return err
+	if i.disabled {
+		return rules, nil
 	}
-	return nil
+	err := inNamespace(ns, func() error {
+		for _, r := range rules {
+			var err error
+			if r.Present, err = i.i.Exists(r.Table, r.Chain, r.Rule...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return rules, err
 }
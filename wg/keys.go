@@ -0,0 +1,93 @@
+package wg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	keyDirMode  = 0700
+	keyFileMode = 0600
+)
+
+func GenerateKey() (string, error) {
+	return wgTool("", "genkey")
+}
+
+func PublicKey(privateKey string) (string, error) {
+	return wgTool(privateKey, "pubkey")
+}
+
+func ReadKeyFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(contents))
+	if key == "" {
+		return "", fmt.Errorf("Key file is empty: %s", path)
+	}
+	return key, nil
+}
+
+// Keys are written to a temporary file first so a crash can never leave a
+// truncated key behind.
+func WriteKeyFile(path, key string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, keyDirMode); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(keyFileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.WriteString(key + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func LoadOrCreateKey(lg *Logger, path string) (string, error) {
+	key, err := ReadKeyFile(path)
+	if err == nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return "", fmt.Errorf("Key file %s is accessible by other users (mode %v)", path, info.Mode().Perm())
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	key, err = GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	if err = WriteKeyFile(path, key); err != nil {
+		return "", fmt.Errorf("Failed to persist generated key: %v", err)
+	}
+	lg.Info("Generated new wireguard private key", "path", path)
+	return key, nil
+}
@@ -0,0 +1,228 @@
+package wg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-systemd/journal"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+const (
+	FormatLogfmt  = "logfmt"
+	FormatJSON    = "json"
+	FormatJournal = "journald"
+)
+
+type logOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  int32
+}
+
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+var logger = &Logger{out: &logOutput{w: os.Stderr, format: FormatLogfmt, level: int32(LevelInfo)}}
+
+func GetLogger() *Logger {
+	return logger
+}
+
+func ConfigureLogging(format string, level Level) error {
+	switch format {
+	case FormatLogfmt, FormatJSON:
+	case FormatJournal:
+		if !journal.Enabled() {
+			return fmt.Errorf("journald logging requested but the journal is not available")
+		}
+	default:
+		return fmt.Errorf("Unknown log format %q, expected %s, %s or %s", format, FormatLogfmt, FormatJSON, FormatJournal)
+	}
+
+	logger.out.mu.Lock()
+	logger.out.format = format
+	logger.out.mu.Unlock()
+	SetLogLevel(level)
+	return nil
+}
+
+func SetLogLevel(level Level) {
+	atomic.StoreInt32(&logger.out.level, int32(level))
+}
+
+func LogLevel() Level {
+	return Level(atomic.LoadInt32(&logger.out.level))
+}
+
+func newRequestId() string {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// Returns a logger that adds the given key value pairs to every message.
+func (t *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(t.fields)+len(kv))
+	fields = append(fields, t.fields...)
+	fields = append(fields, kv...)
+	return &Logger{t.out, fields}
+}
+
+func (t *Logger) Debug(msg string, kv ...interface{}) { t.log(LevelDebug, msg, kv) }
+func (t *Logger) Info(msg string, kv ...interface{})  { t.log(LevelInfo, msg, kv) }
+func (t *Logger) Warn(msg string, kv ...interface{})  { t.log(LevelWarn, msg, kv) }
+func (t *Logger) Error(msg string, kv ...interface{}) { t.log(LevelError, msg, kv) }
+
+func (t *Logger) Enabled(level Level) bool {
+	return level >= LogLevel()
+}
+
+// Key material must never end up in the logs, whatever the level.
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"private", "preshared", "psk", "secret"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldValue(key string, value interface{}) interface{} {
+	if sensitive(key) {
+		return "[redacted]"
+	}
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func (t *Logger) log(level Level, msg string, kv []interface{}) {
+	if !t.Enabled(level) {
+		return
+	}
+
+	all := append(append([]interface{}{}, t.fields...), kv...)
+	fields := make(map[string]interface{}, len(all)/2)
+	keys := make([]string, 0, len(all)/2)
+	for i := 0; i < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(all) {
+			value = all[i+1]
+		}
+		if _, ok := fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		fields[key] = fieldValue(key, value)
+	}
+
+	t.out.mu.Lock()
+	defer t.out.mu.Unlock()
+
+	switch t.out.format {
+	case FormatJSON:
+		entry := make(map[string]interface{}, len(fields)+3)
+		for key, value := range fields {
+			entry[key] = value
+		}
+		entry["time"] = time.Now().Format(time.RFC3339Nano)
+		entry["level"] = level.String()
+		entry["msg"] = msg
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"level":"error","msg":"failed to encode log entry: %v"}`, err))
+		}
+		t.out.w.Write(append(line, '\n'))
+	case FormatJournal:
+		vars := make(map[string]string, len(fields))
+		for key, value := range fields {
+			vars[journalField(key)] = fmt.Sprint(value)
+		}
+		journal.Send(msg, journalPriority(level), vars)
+	default:
+		var b strings.Builder
+		fmt.Fprintf(&b, "time=%s level=%s msg=%s", time.Now().Format(time.RFC3339), level, logfmtValue(msg))
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%s", key, logfmtValue(fmt.Sprint(fields[key])))
+		}
+		b.WriteByte('\n')
+		io.WriteString(t.out.w, b.String())
+	}
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func journalField(key string) string {
+	return strings.ToUpper(strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key))
+}
+
+func journalPriority(level Level) journal.Priority {
+	switch level {
+	case LevelDebug:
+		return journal.PriDebug
+	case LevelInfo:
+		return journal.PriInfo
+	case LevelWarn:
+		return journal.PriWarning
+	default:
+		return journal.PriErr
+	}
+}
@@ -0,0 +1,314 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// In mesh mode every host running the network publishes its tunnel identity
+// and container subnet to a registry shared by all of them, and peers with
+// every other host it finds there.  The registry is a directory, typically on
+// a shared mount, holding one json file per host and mesh, named after the
+// mesh and the host's public key so that neither meshes sharing a registry nor
+// hosts sharing a hostname overwrite each other.
+
+const (
+	defaultMeshInterval = 30 * time.Second
+	defaultMeshNetwork  = "default"
+	// Entries not refreshed for this many intervals belong to hosts that are
+	// gone
+	meshExpiryIntervals = 5
+)
+
+type MeshPolicy struct {
+	Registry string
+	Network  string
+	Interval time.Duration
+	Host     string
+	Supernet *net.IPNet
+}
+
+type MeshEntry struct {
+	Network   string
+	Host      string
+	PublicKey string
+	Endpoint  string
+	Address   string
+	Subnets   []string
+	Updated   time.Time
+}
+
+func validateMeshNetwork(val string) error {
+	if val == "" || strings.ContainsAny(val, "/\x00") || strings.HasPrefix(val, ".") {
+		return fmt.Errorf("not usable in a file name")
+	}
+	return nil
+}
+
+func ParseMeshPolicy(options *Options) (*MeshPolicy, error) {
+	if !options.IsSet("registry") {
+		if options.IsSet("mesh_supernet") {
+			return nil, fmt.Errorf("Option mesh_supernet requires registry")
+		}
+		return nil, nil
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	policy := &MeshPolicy{
+		Registry: options.String("registry"),
+		Network:  options.String("mesh_network"),
+		Interval: options.Duration("registry_interval"),
+		Host:     host,
+	}
+	if policy.Interval == 0 {
+		return nil, fmt.Errorf("Option registry_interval must not be 0 in mesh mode")
+	}
+	if options.IsSet("mesh_supernet") {
+		_, policy.Supernet, _ = net.ParseCIDR(options.String("mesh_supernet"))
+	}
+	return policy, nil
+}
+
+// Public keys are base64, which has slashes.
+func meshEntryName(network, publicKey string) string {
+	return network + "-" + strings.NewReplacer("/", "_", "+", "-").Replace(strings.TrimRight(publicKey, "="))
+}
+
+func meshEntryPath(registry, network, publicKey string) string {
+	return filepath.Join(registry, meshEntryName(network, publicKey)+".json")
+}
+
+func (t *Network) meshEntry(policy *MeshPolicy) *MeshEntry {
+	subnets := []string{}
+	// With vxlan the subnet is shared rather than routed
+	if !t.masquerade && t.vxlan == nil {
+		subnets = append(subnets, t.subnet.String())
+	}
+	return &MeshEntry{
+		Network:   policy.Network,
+		Host:      policy.Host,
+		PublicKey: t.PublicKey(),
+		Endpoint:  net.JoinHostPort(t.endpointAddr().String(), fmt.Sprint(t.conf.ListenPort)),
+		Address:   t.conf.Net.IP.String(),
+		Subnets:   subnets,
+		Updated:   time.Now(),
+	}
+}
+
+// Entries are replaced atomically so other hosts never read half of one.  The
+// temporary file starts with a dot to keep it out of readMeshEntries.
+func publishMeshEntry(registry string, entry *MeshEntry) error {
+	contents, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(registry, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(registry, "."+meshEntryName(entry.Network, entry.PublicKey)+".tmp")
+	if err = ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, meshEntryPath(registry, entry.Network, entry.PublicKey))
+}
+
+func readMeshEntries(registry string) ([]*MeshEntry, error) {
+	files, err := ioutil.ReadDir(registry)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*MeshEntry, 0, len(files))
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(registry, name))
+		if err != nil {
+			return nil, err
+		}
+		entry := &MeshEntry{}
+		if err = json.Unmarshal(contents, entry); err != nil {
+			logger.Warn("Ignoring invalid registry entry", "registry", registry, "file", name, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (t *MeshEntry) peer() (*WgPeer, error) {
+	ip := net.ParseIP(t.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid tunnel address %q", t.Address)
+	}
+	if _, _, err := net.SplitHostPort(t.Endpoint); err != nil {
+		return nil, fmt.Errorf("Invalid endpoint %q: %v", t.Endpoint, err)
+	}
+	peer := &WgPeer{
+		PublicKey:  t.PublicKey,
+		Endpoint:   t.Endpoint,
+		AllowedIPs: []*net.IPNet{hostNet(ip)},
+	}
+	for _, str := range t.Subnets {
+		_, subnet, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid subnet %q", str)
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, subnet)
+	}
+	return peer, nil
+}
+
+func samePeer(a, b *WgPeer) bool {
+	return a.Endpoint == b.Endpoint && joinNets(a.AllowedIPs) == joinNets(b.AllowedIPs)
+}
+
+func (t *Network) meshLoop(policy *MeshPolicy) {
+	defer t.background.Done()
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.reconcileMesh(policy); err != nil {
+			t.log.Warn("Failed to reconcile mesh", "registry", policy.Registry, "error", err)
+		}
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// The peers for the entries of the other hosts of the mesh.  A host that came
+// back with a new key leaves its old entry behind until it expires, of entries
+// with the same tunnel address only the latest counts.
+func wantedMeshPeers(lg *Logger, policy *MeshPolicy, publicKey string, now time.Time) (map[string]*WgPeer, error) {
+	entries, err := readMeshEntries(policy.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := now.Add(-meshExpiryIntervals * policy.Interval)
+	latest := make(map[string]*MeshEntry, len(entries))
+	for _, entry := range entries {
+		if entry.Network != policy.Network || entry.PublicKey == publicKey {
+			continue
+		}
+		if entry.Updated.Before(expiry) {
+			lg.Debug("Ignoring expired registry entry", "host", entry.Host, "updated", entry.Updated)
+			continue
+		}
+		if _, err := entry.peer(); err != nil {
+			lg.Warn("Ignoring invalid registry entry", "host", entry.Host, "error", err)
+			continue
+		}
+		if other, ok := latest[entry.Address]; ok && !other.Updated.Before(entry.Updated) {
+			continue
+		}
+		latest[entry.Address] = entry
+	}
+
+	wanted := make(map[string]*WgPeer, len(latest))
+	for _, entry := range latest {
+		peer, _ := entry.peer()
+		wanted[peer.PublicKey] = peer
+	}
+	return wanted, nil
+}
+
+// The peers to set and the keys of those to remove to get from current to
+// wanted.
+func diffMeshPeers(current, wanted map[string]*WgPeer) ([]*WgPeer, []string) {
+	set := make([]*WgPeer, 0)
+	for key, peer := range wanted {
+		if existing, ok := current[key]; !ok || !samePeer(existing, peer) {
+			set = append(set, peer)
+		}
+	}
+	remove := make([]string, 0)
+	for key := range current {
+		if _, ok := wanted[key]; !ok {
+			remove = append(remove, key)
+		}
+	}
+	return set, remove
+}
+
+// Publishes this host's entry and makes the mesh peers of the interface match
+// the other entries in the registry.  Peers from the wg-quick config are left
+// alone.  The monitor restores mesh peers along with the other added peers
+// when it resets the interface, so the cached ones match what is live.
+func (t *Network) reconcileMesh(policy *MeshPolicy) error {
+	entry := t.meshEntry(policy)
+	if t.meshPublished != "" && t.meshPublished != entry.PublicKey {
+		// The key was rotated
+		if err := withdrawMeshEntry(policy, t.meshPublished); err != nil {
+			t.log.Warn("Failed to remove entry of the previous key", "error", err)
+		}
+	}
+	if err := publishMeshEntry(policy.Registry, entry); err != nil {
+		return fmt.Errorf("Failed to publish entry: %v", err)
+	}
+	t.meshPublished = entry.PublicKey
+
+	wanted, err := wantedMeshPeers(t.log, policy, entry.PublicKey, time.Now())
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	current := make(map[string]*WgPeer, len(t.meshPeers))
+	for key, peer := range t.meshPeers {
+		current[key] = peer
+	}
+	t.mu.Unlock()
+
+	set, remove := diffMeshPeers(current, wanted)
+	changed := false
+	for _, peer := range set {
+		key := peer.PublicKey
+		if err := t.setPeer(peer); err != nil {
+			t.log.Warn("Failed to add mesh peer", "peer", key, "error", err)
+			continue
+		}
+		t.mu.Lock()
+		t.meshPeers[key] = peer
+		t.mu.Unlock()
+		t.log.Info("Added mesh peer", "peer", key, "endpoint", peer.Endpoint, "allowed_ips", joinNets(peer.AllowedIPs))
+		changed = true
+	}
+	for _, key := range remove {
+		if err := t.removePeer(key); err != nil {
+			t.log.Warn("Failed to remove mesh peer", "peer", key, "error", err)
+			continue
+		}
+		t.mu.Lock()
+		delete(t.meshPeers, key)
+		t.mu.Unlock()
+		t.log.Info("Removed mesh peer", "peer", key)
+		changed = true
+	}
+	if changed {
+		t.saveState(t.log)
+	}
+	return nil
+}
+
+func withdrawMeshEntry(policy *MeshPolicy, publicKey string) error {
+	err := os.Remove(meshEntryPath(policy.Registry, policy.Network, publicKey))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
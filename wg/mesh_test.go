@@ -0,0 +1,113 @@
+package wg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+const (
+	meshKeySelf  = "c2VsZi9rZXkrZm9yK3Rlc3RpbmcvbWVzaC9lbnRyaWU="
+	meshKeyTwin  = "dHdpbi9rZXkrZm9yK3Rlc3RpbmcvbWVzaC9lbnRyaWU="
+	meshKeyOther = "b3RoZXIva2V5K2Zvcit0ZXN0aW5nL21lc2gvZW50cnk="
+	meshKeyOld   = "b2xkL2tleStmb3IrdGVzdGluZy9tZXNoL2VudHJpZXM="
+	meshKeyNew   = "bmV3L2tleStmb3IrdGVzdGluZy9tZXNoL2VudHJpZXM="
+	meshKeyGone  = "Z29uZS9rZXkrZm9yK3Rlc3RpbmcvbWVzaC9lbnRyeQ=="
+)
+
+func mustPublish(t *testing.T, registry string, entry *MeshEntry) {
+	t.Helper()
+	if err := publishMeshEntry(registry, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileMeshRegistry(t *testing.T) {
+	registry, err := ioutil.TempDir("", "mesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(registry)
+
+	now := time.Now()
+	policy := &MeshPolicy{Registry: registry, Network: "a", Interval: time.Minute, Host: "host1"}
+	for _, entry := range []*MeshEntry{
+		{Network: "a", Host: "host1", PublicKey: meshKeySelf, Endpoint: "192.0.2.1:51820", Address: "10.1.0.1", Updated: now},
+		// Same hostname, different host
+		{Network: "a", Host: "host1", PublicKey: meshKeyTwin, Endpoint: "192.0.2.2:51820", Address: "10.1.0.2", Subnets: []string{"172.20.2.0/24"}, Updated: now},
+		// Same host in another mesh sharing the registry
+		{Network: "b", Host: "host1", PublicKey: meshKeySelf, Endpoint: "192.0.2.1:51821", Address: "10.2.0.1", Updated: now},
+		{Network: "b", Host: "host3", PublicKey: meshKeyOther, Endpoint: "192.0.2.3:51821", Address: "10.2.0.3", Updated: now},
+		// A host that came back with a new key
+		{Network: "a", Host: "host4", PublicKey: meshKeyOld, Endpoint: "192.0.2.4:51820", Address: "10.1.0.4", Updated: now.Add(-2 * time.Minute)},
+		{Network: "a", Host: "host4", PublicKey: meshKeyNew, Endpoint: "192.0.2.4:51820", Address: "10.1.0.4", Updated: now},
+		{Network: "a", Host: "host5", PublicKey: meshKeyGone, Endpoint: "192.0.2.5:51820", Address: "10.1.0.5", Updated: now.Add(-time.Hour)},
+		{Network: "a", Host: "host6", PublicKey: meshKeyOther, Endpoint: "192.0.2.6", Address: "10.1.0.6", Updated: now},
+	} {
+		mustPublish(t, registry, entry)
+	}
+	if err = ioutil.WriteFile(filepath.Join(registry, "broken.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(registry, "*.json"))
+	if len(files) != 9 {
+		t.Errorf("Registry holds %d files, expected one for each of 8 entries and the broken one", len(files))
+	}
+
+	wanted, err := wantedMeshPeers(logger, policy, meshKeySelf, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(wanted))
+	for key := range wanted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != meshKeyNew || keys[1] != meshKeyTwin {
+		t.Fatalf("Wanted peers %v, expected the twin and the new key of host4", keys)
+	}
+	if allowed := joinNets(wanted[meshKeyTwin].AllowedIPs); allowed != "10.1.0.2/32, 172.20.2.0/24" {
+		t.Errorf("Twin peer has allowed ips %s", allowed)
+	}
+
+	// The cached peers after a previous round, one of them since moved
+	current := map[string]*WgPeer{
+		meshKeyTwin: {PublicKey: meshKeyTwin, Endpoint: "192.0.2.99:51820", AllowedIPs: wanted[meshKeyTwin].AllowedIPs},
+		meshKeyNew:  wanted[meshKeyNew],
+		meshKeyOld:  {PublicKey: meshKeyOld, Endpoint: "192.0.2.4:51820", AllowedIPs: wanted[meshKeyNew].AllowedIPs},
+	}
+	set, remove := diffMeshPeers(current, wanted)
+	if len(set) != 1 || set[0].PublicKey != meshKeyTwin || set[0].Endpoint != "192.0.2.2:51820" {
+		t.Errorf("Setting %v, expected only the moved twin", set)
+	}
+	if len(remove) != 1 || remove[0] != meshKeyOld {
+		t.Errorf("Removing %v, expected the old key of host4", remove)
+	}
+	if set, remove = diffMeshPeers(wanted, wanted); len(set) != 0 || len(remove) != 0 {
+		t.Errorf("Reconciling with nothing changed sets %d and removes %d peers", len(set), len(remove))
+	}
+
+	// Withdrawing leaves the same host's entry in the other mesh alone
+	if err = withdrawMeshEntry(policy, meshKeySelf); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readMeshEntries(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.PublicKey == meshKeySelf && entry.Network == "a" {
+			t.Errorf("Withdrawn entry is still in the registry")
+		}
+	}
+	if len(entries) != 7 {
+		t.Errorf("Read %d entries after withdrawing one of 8", len(entries))
+	}
+	if err = withdrawMeshEntry(policy, meshKeySelf); err != nil {
+		t.Errorf("Withdrawing twice: %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package wg
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/network"
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+type requestStats struct {
+	count   uint64
+	errors  uint64
+	sum     float64
+	buckets []uint64
+}
+
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[string]*requestStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{requests: make(map[string]*requestStats)}
+}
+
+func (t *Metrics) observe(method string, start time.Time, err error) {
+	elapsed := time.Since(start).Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.requests[method]
+	if !ok {
+		stats = &requestStats{buckets: make([]uint64, len(latencyBuckets))}
+		t.requests[method] = stats
+	}
+	stats.count++
+	if err != nil {
+		stats.errors++
+	}
+	stats.sum += elapsed
+	for i, bound := range latencyBuckets {
+		if elapsed <= bound {
+			stats.buckets[i]++
+		}
+	}
+}
+
+func (t *Metrics) write(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	methods := make([]string, 0, len(t.requests))
+	for method := range t.requests {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintf(w, "# HELP wgdocker_requests_total Plugin requests handled, by method.\n")
+	fmt.Fprintf(w, "# TYPE wgdocker_requests_total counter\n")
+	for _, method := range methods {
+		fmt.Fprintf(w, "wgdocker_requests_total{method=%q} %d\n", method, t.requests[method].count)
+	}
+	fmt.Fprintf(w, "# HELP wgdocker_request_errors_total Plugin requests that returned an error, by method.\n")
+	fmt.Fprintf(w, "# TYPE wgdocker_request_errors_total counter\n")
+	for _, method := range methods {
+		fmt.Fprintf(w, "wgdocker_request_errors_total{method=%q} %d\n", method, t.requests[method].errors)
+	}
+	fmt.Fprintf(w, "# HELP wgdocker_request_duration_seconds Time taken to handle plugin requests, by method.\n")
+	fmt.Fprintf(w, "# TYPE wgdocker_request_duration_seconds histogram\n")
+	for _, method := range methods {
+		stats := t.requests[method]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "wgdocker_request_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, bound, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "wgdocker_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, stats.count)
+		fmt.Fprintf(w, "wgdocker_request_duration_seconds_sum{method=%q} %g\n", method, stats.sum)
+		fmt.Fprintf(w, "wgdocker_request_duration_seconds_count{method=%q} %d\n", method, stats.count)
+	}
+}
+
+type networkMetrics struct {
+	id              string
+	endpoints       int
+	allocatorUsed   int
+	allocatorSize   int
+	iptablesRepairs uint64
+	peers           []*PeerStatus
+}
+
+func (t *Network) metrics() *networkMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := make([]*PeerStatus, 0, len(t.peerStatus))
+	for _, peer := range t.peerStatus {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+
+	return &networkMetrics{
+		id:              t.id,
+		endpoints:       len(t.endpoints),
+		allocatorUsed:   t.ipAllocator.Used(),
+		allocatorSize:   t.ipAllocator.Size(),
+		iptablesRepairs: t.iptablesRepairs,
+		peers:           peers,
+	}
+}
+
+func writeNetworkMetrics(w io.Writer, networks []*networkMetrics) {
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	counter := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+
+	gauge("wgdocker_networks", "Networks currently managed by the driver.")
+	fmt.Fprintf(w, "wgdocker_networks %d\n", len(networks))
+
+	gauge("wgdocker_network_endpoints", "Endpoints attached to the network.")
+	for _, net := range networks {
+		fmt.Fprintf(w, "wgdocker_network_endpoints{network=%q} %d\n", net.id, net.endpoints)
+	}
+	gauge("wgdocker_allocator_used_addresses", "Addresses in use in the network's container subnet.")
+	for _, net := range networks {
+		fmt.Fprintf(w, "wgdocker_allocator_used_addresses{network=%q} %d\n", net.id, net.allocatorUsed)
+	}
+	gauge("wgdocker_allocator_size_addresses", "Addresses available in the network's container subnet.")
+	for _, net := range networks {
+		fmt.Fprintf(w, "wgdocker_allocator_size_addresses{network=%q} %d\n", net.id, net.allocatorSize)
+	}
+	counter("wgdocker_iptables_repairs_total", "Forwarding rules that had gone missing and were restored.")
+	for _, net := range networks {
+		fmt.Fprintf(w, "wgdocker_iptables_repairs_total{network=%q} %d\n", net.id, net.iptablesRepairs)
+	}
+
+	now := time.Now()
+	gauge("wgdocker_peer_last_handshake_age_seconds", "Seconds since the latest handshake with the peer, -1 if there never was one.")
+	for _, net := range networks {
+		for _, peer := range net.peers {
+			age := -1.0
+			if !peer.LatestHandshake.IsZero() {
+				age = now.Sub(peer.LatestHandshake).Seconds()
+			}
+			fmt.Fprintf(w, "wgdocker_peer_last_handshake_age_seconds{network=%q,peer=%q} %g\n", net.id, peer.PublicKey, age)
+		}
+	}
+	gauge("wgdocker_peer_stale", "Whether the peer's latest handshake is older than the handshake timeout.")
+	for _, net := range networks {
+		for _, peer := range net.peers {
+			stale := 0
+			if peer.Stale {
+				stale = 1
+			}
+			fmt.Fprintf(w, "wgdocker_peer_stale{network=%q,peer=%q} %d\n", net.id, peer.PublicKey, stale)
+		}
+	}
+	counter("wgdocker_peer_receive_bytes_total", "Bytes received from the peer.")
+	for _, net := range networks {
+		for _, peer := range net.peers {
+			fmt.Fprintf(w, "wgdocker_peer_receive_bytes_total{network=%q,peer=%q} %d\n", net.id, peer.PublicKey, peer.RxBytes)
+		}
+	}
+	counter("wgdocker_peer_transmit_bytes_total", "Bytes sent to the peer.")
+	for _, net := range networks {
+		for _, peer := range net.peers {
+			fmt.Fprintf(w, "wgdocker_peer_transmit_bytes_total{network=%q,peer=%q} %d\n", net.id, peer.PublicKey, peer.TxBytes)
+		}
+	}
+}
+
+func (t *Driver) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	networks := make([]*networkMetrics, 0, len(t.networks))
+	for _, net := range t.networks {
+		networks = append(networks, net.metrics())
+	}
+	t.mu.Unlock()
+	sort.Slice(networks, func(i, j int) bool { return networks[i].id < networks[j].id })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	t.metrics.write(w)
+	writeNetworkMetrics(w, networks)
+}
+
+func (t *Driver) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", t.handleMetrics)
+	logger.Info("Serving metrics", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// Records request counts and latencies for every plugin call before handing
+// it to the driver.
+type InstrumentedDriver struct {
+	driver *Driver
+}
+
+func (t *Driver) Instrumented() *InstrumentedDriver {
+	return &InstrumentedDriver{t}
+}
+
+func (t *InstrumentedDriver) GetCapabilities() (*network.CapabilitiesResponse, error) {
+	start := time.Now()
+	res, err := t.driver.GetCapabilities()
+	t.driver.metrics.observe("GetCapabilities", start, err)
+	return res, err
+}
+
+func (t *InstrumentedDriver) CreateNetwork(req *network.CreateNetworkRequest) error {
+	start := time.Now()
+	err := t.driver.CreateNetwork(req)
+	t.driver.metrics.observe("CreateNetwork", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) AllocateNetwork(req *network.AllocateNetworkRequest) (*network.AllocateNetworkResponse, error) {
+	start := time.Now()
+	res, err := t.driver.AllocateNetwork(req)
+	t.driver.metrics.observe("AllocateNetwork", start, err)
+	return res, err
+}
+
+func (t *InstrumentedDriver) DeleteNetwork(req *network.DeleteNetworkRequest) error {
+	start := time.Now()
+	err := t.driver.DeleteNetwork(req)
+	t.driver.metrics.observe("DeleteNetwork", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) FreeNetwork(req *network.FreeNetworkRequest) error {
+	start := time.Now()
+	err := t.driver.FreeNetwork(req)
+	t.driver.metrics.observe("FreeNetwork", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) CreateEndpoint(req *network.CreateEndpointRequest) (*network.CreateEndpointResponse, error) {
+	start := time.Now()
+	res, err := t.driver.CreateEndpoint(req)
+	t.driver.metrics.observe("CreateEndpoint", start, err)
+	return res, err
+}
+
+func (t *InstrumentedDriver) DeleteEndpoint(req *network.DeleteEndpointRequest) error {
+	start := time.Now()
+	err := t.driver.DeleteEndpoint(req)
+	t.driver.metrics.observe("DeleteEndpoint", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) EndpointInfo(req *network.InfoRequest) (*network.InfoResponse, error) {
+	start := time.Now()
+	res, err := t.driver.EndpointInfo(req)
+	t.driver.metrics.observe("EndpointInfo", start, err)
+	return res, err
+}
+
+func (t *InstrumentedDriver) Join(req *network.JoinRequest) (*network.JoinResponse, error) {
+	start := time.Now()
+	res, err := t.driver.Join(req)
+	t.driver.metrics.observe("Join", start, err)
+	return res, err
+}
+
+func (t *InstrumentedDriver) Leave(req *network.LeaveRequest) error {
+	start := time.Now()
+	err := t.driver.Leave(req)
+	t.driver.metrics.observe("Leave", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) DiscoverNew(req *network.DiscoveryNotification) error {
+	start := time.Now()
+	err := t.driver.DiscoverNew(req)
+	t.driver.metrics.observe("DiscoverNew", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) DiscoverDelete(req *network.DiscoveryNotification) error {
+	start := time.Now()
+	err := t.driver.DiscoverDelete(req)
+	t.driver.metrics.observe("DiscoverDelete", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) ProgramExternalConnectivity(req *network.ProgramExternalConnectivityRequest) error {
+	start := time.Now()
+	err := t.driver.ProgramExternalConnectivity(req)
+	t.driver.metrics.observe("ProgramExternalConnectivity", start, err)
+	return err
+}
+
+func (t *InstrumentedDriver) RevokeExternalConnectivity(req *network.RevokeExternalConnectivityRequest) error {
+	start := time.Now()
+	err := t.driver.RevokeExternalConnectivity(req)
+	t.driver.metrics.observe("RevokeExternalConnectivity", start, err)
+	return err
+}
@@ -0,0 +1,281 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMonitorInterval  = 30 * time.Second
+	defaultHandshakeTimeout = 3 * time.Minute
+	defaultRecoveryTimeout  = 10 * time.Minute
+)
+
+type MonitorPolicy struct {
+	Interval         time.Duration
+	HandshakeTimeout time.Duration
+	RecoveryTimeout  time.Duration
+}
+
+type PeerStatus struct {
+	PublicKey       string
+	Endpoint        string
+	AllowedIPs      []string
+	LatestHandshake time.Time
+	RxBytes         uint64
+	TxBytes         uint64
+	Stale           bool
+	StaleSince      time.Time
+}
+
+func ParseMonitorPolicy(options *Options) *MonitorPolicy {
+	interval := options.Duration("monitor_interval")
+	if interval == 0 {
+		return nil
+	}
+	return &MonitorPolicy{interval, options.Duration("handshake_timeout"), options.Duration("recovery_timeout")}
+}
+
+func parseDump(dump string) ([]*PeerStatus, error) {
+	lines := strings.Split(dump, "\n")
+	peers := make([]*PeerStatus, 0, len(lines))
+	// The first line describes the interface itself.
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, fmt.Errorf("Unexpected line in wg dump: %q", line)
+		}
+		handshake, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		rx, err := strconv.ParseUint(fields[5], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := strconv.ParseUint(fields[6], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		status := &PeerStatus{
+			PublicKey:  fields[0],
+			AllowedIPs: strings.Split(fields[3], ","),
+			RxBytes:    rx,
+			TxBytes:    tx,
+		}
+		if fields[2] != "(none)" {
+			status.Endpoint = fields[2]
+		}
+		if handshake != 0 {
+			status.LatestHandshake = time.Unix(handshake, 0)
+		}
+		peers = append(peers, status)
+	}
+	return peers, nil
+}
+
+func (t *Network) readPeerStatus() ([]*PeerStatus, error) {
+	dump, err := wgCommand(t.ns, "", "show", t.wgInterface(), "dump")
+	if err != nil {
+		return nil, err
+	}
+	return parseDump(dump)
+}
+
+func (t *Network) PeerStatus() []*PeerStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make([]*PeerStatus, 0, len(t.peerStatus))
+	for _, peer := range t.peerStatus {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (t *Network) monitorLoop(policy *MonitorPolicy) {
+	defer t.background.Done()
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	// Only escalate to restarting the interface once re-applying the peer
+	// configuration had a full recovery timeout to take effect.
+	var reapplied time.Time
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		t.repairForwarding()
+
+		stale, err := t.checkPeers(policy)
+		if err != nil {
+			t.log.Warn("Failed to check peers", "error", err)
+			continue
+		}
+
+		t.resolvePeerEndpoints()
+
+		if stale.IsZero() || time.Since(stale) < policy.RecoveryTimeout {
+			reapplied = time.Time{}
+			continue
+		}
+
+		if reapplied.IsZero() {
+			t.log.Warn("Peers are down, re-applying peer configuration", "down_since", stale)
+			if err := t.reapplyPeers(); err != nil {
+				t.log.Error("Failed to re-apply peers", "error", err)
+			}
+			reapplied = time.Now()
+		} else if time.Since(reapplied) >= policy.RecoveryTimeout {
+			t.log.Warn("Peers are still down, restarting interface")
+			if err := t.restartInterface(); err != nil {
+				t.log.Error("Failed to restart interface", "error", err)
+			}
+			reapplied = time.Time{}
+		}
+	}
+}
+
+func (t *Network) repairForwarding() {
+	t.forwardingMu.Lock()
+	repaired, err := t.iptables.RepairForwarding(t.rootNs, t.outboundAddr, t.endpointAddr(), t.conf.ListenPort)
+	t.forwardingMu.Unlock()
+	if repaired > 0 {
+		t.log.Warn("Restored missing forwarding rules", "count", repaired)
+		t.mu.Lock()
+		t.iptablesRepairs += uint64(repaired)
+		t.mu.Unlock()
+	}
+	if err != nil {
+		t.log.Error("Failed to check forwarding rules", "error", err)
+	}
+}
+
+// Updates the status of every peer and returns the time since which the
+// longest stale peer has been down.  Peers without a configured endpoint can
+// only be waited on, so they never trigger recovery.
+func (t *Network) checkPeers(policy *MonitorPolicy) (time.Time, error) {
+	peers, err := t.readPeerStatus()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active := make(map[string]struct{})
+	for _, peer := range t.conf.Peers {
+		if peer.Endpoint != "" {
+			active[peer.PublicKey] = struct{}{}
+		}
+	}
+
+	var oldest time.Time
+	now := time.Now()
+	statuses := make(map[string]*PeerStatus, len(peers))
+	for _, peer := range peers {
+		previous := t.peerStatus[peer.PublicKey]
+
+		peer.Stale = now.Sub(peer.LatestHandshake) > policy.HandshakeTimeout
+		if peer.Stale {
+			if previous != nil && previous.Stale {
+				peer.StaleSince = previous.StaleSince
+			} else {
+				peer.StaleSince = now
+				t.log.Warn("Peer is stale", "peer", peer.PublicKey, "latest_handshake", peer.LatestHandshake)
+			}
+			_, isActive := active[peer.PublicKey]
+			if isActive && (oldest.IsZero() || peer.StaleSince.Before(oldest)) {
+				oldest = peer.StaleSince
+			}
+		} else if previous != nil && previous.Stale {
+			t.log.Info("Peer recovered", "peer", peer.PublicKey)
+		}
+		statuses[peer.PublicKey] = peer
+	}
+	t.peerStatus = statuses
+	return oldest, nil
+}
+
+// Peers configured with a hostname are only resolved once by wg-quick, so
+// follow any changes to the records.
+func (t *Network) resolvePeerEndpoints() {
+	for _, peer := range t.peers() {
+		if peer.Endpoint == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(peer.Endpoint)
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil || len(addrs) == 0 {
+			t.log.Warn("Failed to resolve peer endpoint", "peer", peer.PublicKey, "endpoint", peer.Endpoint, "error", err)
+			continue
+		}
+
+		t.mu.Lock()
+		status := t.peerStatus[peer.PublicKey]
+		t.mu.Unlock()
+		if status == nil {
+			continue
+		}
+
+		current := false
+		for _, addr := range addrs {
+			if net.JoinHostPort(addr.String(), port) == status.Endpoint {
+				current = true
+			}
+		}
+		if current {
+			continue
+		}
+
+		endpoint := net.JoinHostPort(addrs[0].String(), port)
+		t.log.Info("Peer endpoint resolves to a new address", "peer", peer.PublicKey, "endpoint", peer.Endpoint, "address", endpoint)
+		_, err = wgCommand(t.ns, "", "set", t.wgInterface(), "peer", peer.PublicKey, "endpoint", endpoint)
+		if err != nil {
+			t.log.Error("Failed to update peer endpoint", "peer", peer.PublicKey, "error", err)
+		}
+	}
+}
+
+func (t *Network) reapplyPeers() error {
+	stripped, err := exec.Command("wg-quick", "strip", t.conf.Path).Output()
+	if err != nil {
+		return fmt.Errorf("wg-quick strip failed: %v", err)
+	}
+	intf := t.wgInterface()
+	if _, err = wgCommand(t.ns, string(stripped), "syncconf", intf, "/dev/stdin"); err != nil {
+		return err
+	}
+	if err = t.restoreAddedPeers(); err != nil {
+		return err
+	}
+	return configureInterface(t.log, t.ns, intf, t.conf, t.peers(), t.keyPath, t.stateDir, t.id)
+}
+
+func (t *Network) restartInterface() error {
+	if err := t.conf.StopInterface(t.log, t.ns); err != nil {
+		t.log.Warn("Failed to bring down interface", "error", err)
+	}
+	link, err := t.conf.StartInterface(t.log, t.ns, t.nl)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.wgLink = link
+	t.mu.Unlock()
+	if err = t.restoreAddedPeers(); err != nil {
+		return err
+	}
+	return configureInterface(t.log, t.ns, link.Attrs().Name, t.conf, t.peers(), t.keyPath, t.stateDir, t.id)
+}
@@ -2,100 +2,156 @@ package wg
 
 import (
 	"fmt"
-	"log"
 	"net"
-	"strconv"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/docker/go-plugins-helpers/network"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
-const (
-	LINK_PREFIX = "wgdocknet"
-)
-
 type Network struct {
+	mu           sync.Mutex
+	log          *Logger
+	id           string
+	stateDir     string
+	keyPath      string
+	options      *Options
 	ns           netns.NsHandle
 	nl           *netlink.Handle
 	rootNs       netns.NsHandle
 	rootNl       *netlink.Handle
 	name         *string
 	conf         *WgConfig
+	wgLink       netlink.Link
+	publicKey    string
+	subnet       *net.IPNet
+	masquerade   bool
+	routed       bool
 	bridge       *netlink.Bridge
 	bridgeNet    *net.IPNet
+	gateway      netlink.Link // Holds bridgeNet, a dummy in routed mode where bridge is nil
+	auxAddresses map[string]net.IP
 	ipAllocator  *IpAllocator
+	// Set if the subnet is a pool of the ipam driver, which then owns the
+	// container addresses
+	ipamPool string
+	// Set for networks in global scope
+	global *globalTunnel
+	// Set in mesh mode, along with the peers taken from the registry and the
+	// key this host's entry was last published under
+	mesh          *MeshPolicy
+	meshPeers     map[string]*WgPeer
+	meshPublished string
+	// Set if the bridge is extended to the peers' bridges
+	vxlan *netlink.Vxlan
+	// Peers set at runtime rather than read from the config file, re-applying
+	// the config file drops them
+	addedPeers map[string]*WgPeer
+
 	wgEndpoint   net.IP
 	outboundAddr net.IP
 	outboundIntf netlink.Link
 	iptables     *Iptables
-
-	endpoints  map[string]*Endpoint
-	interfaces map[string]string
+	// Serialises changes to the forwarding rules
+	forwardingMu sync.Mutex
+	// Serialises CreatePeer, which runs without the driver lock
+	exportMu sync.Mutex
+
+	endpoints endpointTable
+
+	lastRotation    time.Time
+	peerStatus      map[string]*PeerStatus
+	iptablesRepairs uint64
+	stop            chan struct{}
+	background      sync.WaitGroup
 }
 
-func getOpt(options map[string]interface{}, name string) *string {
-	val, ok := options[name]
-	if ok {
-		str := val.(string)
-		return &str
-	} else {
-		return nil
-	}
-}
-
-func CreateNetwork(data *network.IPAMData, options map[string]interface{}, rootNs netns.NsHandle, iptables *Iptables) (*Network, error) {
+// Everything set up is undone if it fails partway.  With the cleanup option
+// off the namespace is kept, along with the links inside it and the outbound
+// link into it.  dockerNets are docker's subnets, which the
+// transit addresses must not overlap.
+func CreateNetwork(lg *Logger, id string, data *network.IPAMData, options *Options, pool *ipamPool, rootNs netns.NsHandle, iptables *Iptables, stateDir string, persist bool, dockerNets []*net.IPNet) (created *Network, err error) {
 	var ns netns.NsHandle
-	var err error
 
-	var doCleanup bool
-	if val := getOpt(options, "cleanup"); val != nil {
-		doCleanup, err = strconv.ParseBool(*val)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		doCleanup = true
-	}
+	doCleanup := options.Bool("cleanup")
+	confPath := options.String("wgconf")
 
-	confPath := getOpt(options, "wgconf")
+	keyPath := options.String("keyfile")
+	if keyPath == "" {
+		keyPath = filepath.Join(stateDir, "keys", id+".key")
+	}
 
-	wgEndpointAddr := getOpt(options, "endpoint")
-	if wgEndpointAddr == nil {
-		return nil, fmt.Errorf("No endpoint address provided")
+	rootNl, err := netlink.NewHandleAt(rootNs)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting handle of root namespace: %v", err)
 	}
 
-	wgEndpoint := net.ParseIP(*wgEndpointAddr)
-	if wgEndpoint == nil {
-		return nil, fmt.Errorf("Invalid endpoint address given: %s", *wgEndpointAddr)
+	wgEndpoint, err := resolveEndpoint(rootNl, options.String("endpoint"))
+	if err != nil {
+		return nil, err
 	}
 
-	rootNl, err := netlink.NewHandleAt(rootNs)
+	conf, err := ParseWgConfig(confPath)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting handle of root namespace: %v", err)
+		return nil, err
 	}
+	lg.Info("Loaded wireguard config", "path", conf.Path, "address", conf.Net, "listen_port", conf.ListenPort, "peers", len(conf.Peers))
 
-	if confPath == nil {
-		return nil, fmt.Errorf("Wireguard config file not present")
+	global, err := parseGlobalTunnel(options)
+	if err != nil {
+		return nil, err
+	}
+	mesh, err := ParseMeshPolicy(options)
+	if err != nil {
+		return nil, err
+	}
+	rotation, err := ParseRotationPolicy(options)
+	if err != nil {
+		return nil, err
+	}
+	monitor := ParseMonitorPolicy(options)
+	vxlanPolicy := ParseVxlanPolicy(options)
+	if rotation != nil && rotation.RotateKey && conf.HasPrivateKey {
+		return nil, fmt.Errorf("rotate_key requires the private key to be managed by the driver, remove PrivateKey from %s", confPath)
+	}
+	masquerade := options.Bool("masquerade")
+	routed := options.Bool("routed")
+	if routed && vxlanPolicy != nil {
+		return nil, fmt.Errorf("Option vxlan extends the bridge, which routed networks don't have")
 	}
 
-	conf, err := ParseWgConfig(*confPath)
+	exportedPeers, err := loadExportedPeers(exportedPeersPath(stateDir, id))
 	if err != nil {
 		return nil, err
 	}
-	str := spew.Sdump(*conf)
-	log.Printf("Loaded wireguard config: %s\n", str)
+	for _, peer := range exportedPeers {
+		wgPeer := peer.WgPeer()
+		conf.Peers = append(conf.Peers, wgPeer)
+		conf.PeerNets = append(conf.PeerNets, wgPeer.AllowedIPs...)
+	}
 
-	name := getOpt(options, "namespace")
+	var name *string
+	if options.IsSet("namespace") {
+		namespace := options.String("namespace")
+		name = &namespace
+	}
+	if name == nil && persist {
+		// An anonymous namespace would not outlive the driver
+		persistentName := GetConfig().LinkPrefix + "-" + ShortId(id)
+		name = &persistentName
+	}
 	if name != nil {
-		log.Printf("Creating namespace: %s\n", *name)
+		lg.Info("Creating namespace", "namespace", *name)
 		ns, err = netns.NewNamed(*name)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		log.Printf("Creating anonymous namespace\n")
+		lg.Info("Creating anonymous namespace")
 		ns, err = netns.New()
 		if err != nil {
 			return nil, err
@@ -103,14 +159,13 @@ func CreateNetwork(data *network.IPAMData, options map[string]interface{}, rootN
 	}
 	defer func() {
 		if err != nil && doCleanup {
-			err = deleteNs(ns, name)
-			if err != nil {
-				log.Printf("Failed to cleanup namespace: %v\n", err)
+			if err := deleteNs(ns, name); err != nil {
+				lg.Error("Failed to cleanup namespace", "error", err)
 			}
 		}
 	}()
 
-	log.Printf("Created namespace at fd %d\n", ns)
+	lg.Debug("Created namespace", "fd", int(ns))
 
 	nl, err := netlink.NewHandleAt(ns)
 	if err != nil {
@@ -122,66 +177,221 @@ func CreateNetwork(data *network.IPAMData, options map[string]interface{}, rootN
 		}
 	}()
 
-	outboundAddr, outboundIntf, err := createOutboundLink(ns, rootNs, nl, rootNl)
+	transit, err := parseTransitRange(options.String("transit_range"))
+	if err != nil {
+		return nil, err
+	}
+	transitOuter, transitInner, err := allocateTransit(lg, rootNl, stateDir, id, transit, dockerNets)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			// Docker retries under a new id, the /31 would never be freed
+			if err := releaseTransit(stateDir, id); err != nil {
+				lg.Warn("Failed to release transit addresses", "error", err)
+			}
+		}
+	}()
+	outboundAddr, outboundIntf, err := createOutboundLink(ns, rootNs, nl, rootNl, transitOuter, transitInner)
+	if err != nil {
+		return nil, err
+	}
+
+	wgLink, err := conf.StartInterface(lg, ns, nl)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = conf.StartInterface(nl)
+	err = configureInterface(lg, ns, wgLink.Attrs().Name, conf, conf.Peers, keyPath, stateDir, id)
 	if err != nil {
 		return nil, err
 	}
 
+	publicKey, err := wgCommand(ns, "", "show", wgLink.Attrs().Name, "public-key")
+	if err != nil {
+		return nil, err
+	}
+	lg.Info("Wireguard interface is up", "interface", wgLink.Attrs().Name, "public_key", publicKey)
+
 	_, subnet, err := net.ParseCIDR(data.Pool)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse assigned pool")
 	}
 
-	ipAllocator := CreateIpAllocator(subnet)
-	ipAllocator.MarkUsed(conf.Net.IP)
-	log.Printf("Marking wireguard link address used: %v", conf.Net.IP)
+	var ipAllocator *IpAllocator
+	ipamPool := ""
+	if pool != nil {
+		if err = pool.claimNetwork(subnet, conf, options); err != nil {
+			return nil, err
+		}
+		ipAllocator = pool.allocator
+		ipamPool = pool.id
+		lg.Info("Sharing the allocator of the ipam pool", "pool", pool.id)
+	} else {
+		ipAllocator, err = createNetworkAllocator(subnet, options)
+		if err != nil {
+			return nil, err
+		}
+		ipAllocator.MarkUsed(conf.Net.IP)
+	}
+	lg.Debug("Marking wireguard link address used", "address", conf.Net.IP)
 
-	bridgeNet, err := ipAllocator.FindAddress()
+	auxAddresses, err := reserveAuxAddresses(data, subnet, conf, ipAllocator)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to find address for bridge: %v", err)
+		return nil, err
 	}
-
-	bridge, err := createBridge(nl, bridgeNet)
+	bridgeNet, err := gatewayAddress(data, subnet, conf, ipAllocator, pool != nil)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("Created bridge with subnet: %v", bridgeNet)
+
+	var bridge *netlink.Bridge
+	var gateway netlink.Link
+	if routed {
+		gateway, err = createGatewayLink(nl, bridgeNet)
+		if err != nil {
+			return nil, err
+		}
+		lg.Info("Created gateway link", "subnet", bridgeNet)
+	} else {
+		bridge, err = createBridge(nl, bridgeNet)
+		if err != nil {
+			return nil, err
+		}
+		gateway = bridge
+		lg.Info("Created bridge", "subnet", bridgeNet)
+	}
+
+	var vxlan *netlink.Vxlan
+	if vxlanPolicy != nil {
+		if global == nil {
+			var hostRange *net.IPNet
+			if pool != nil {
+				hostRange = pool.subRange()
+			} else if options.IsSet("ip_range") {
+				_, hostRange, _ = net.ParseCIDR(options.String("ip_range"))
+			}
+			if err = checkVxlanGateway(bridgeNet.IP, hostRange); err != nil {
+				return nil, err
+			}
+		}
+		vxlan, err = createVxlan(nl, vxlanPolicy, wgLink, conf.Net.IP, bridge)
+		if err != nil {
+			return nil, err
+		}
+		for _, peer := range conf.Peers {
+			if err = setFloodEntries(lg, nl, vxlan, conf.Net, peer, false); err != nil {
+				return nil, err
+			}
+		}
+		lg.Info("Extended bridge with vxlan", "vni", vxlanPolicy.Id, "port", vxlanPolicy.Port, "mtu", vxlan.MTU)
+		if global != nil {
+			if err = setAnycastGateway(nl, bridge, bridgeNet.IP); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if masquerade {
+		err = iptables.SetupMasquerade(ns, subnet, wgLink.Attrs().Name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to setup masquerading: %v", err)
+		}
+		defer func() {
+			if err != nil {
+				if err := iptables.RemoveMasquerade(ns, subnet, wgLink.Attrs().Name); err != nil {
+					lg.Warn("Failed to remove masquerade rule", "error", err)
+				}
+			}
+		}()
+		lg.Info("Masquerading container subnet", "subnet", subnet, "address", conf.Net.IP)
+	}
 
 	port := conf.ListenPort
 	err = iptables.SetupForwarding(rootNs, outboundAddr, wgEndpoint, port)
 	if err != nil {
+		// Some of the rules may already be in
+		if err := iptables.RemoveForwarding(rootNs, outboundAddr, wgEndpoint, port); err != nil {
+			lg.Warn("Failed to remove forwarding rules", "error", err)
+		}
 		return nil, err
 	}
-	log.Printf("Setup iptables forwarding rules %v:%d <-> %v:%d", wgEndpoint, port, outboundAddr, port)
-
-	endpoints := make(map[string]*Endpoint, 0)
-	interfaces := make(map[string]string, 0)
-
-	return &Network{
-		ns,
-		nl,
-		rootNs,
-		rootNl,
-		name,
-		conf,
-		bridge,
-		bridgeNet,
-		ipAllocator,
-		wgEndpoint,
-		outboundAddr,
-		outboundIntf,
-		iptables,
-		endpoints,
-		interfaces,
-	}, nil
+	lg.Info("Setup iptables forwarding rules", "endpoint", wgEndpoint, "outbound", outboundAddr, "port", port)
+
+	endpoints := make(endpointTable, 0)
+
+	network := &Network{
+		log:          logger.With("network", id),
+		id:           id,
+		stateDir:     stateDir,
+		keyPath:      keyPath,
+		options:      options,
+		ns:           ns,
+		nl:           nl,
+		rootNs:       rootNs,
+		rootNl:       rootNl,
+		name:         name,
+		conf:         conf,
+		wgLink:       wgLink,
+		publicKey:    publicKey,
+		subnet:       subnet,
+		masquerade:   masquerade,
+		routed:       routed,
+		bridge:       bridge,
+		gateway:      gateway,
+		bridgeNet:    bridgeNet,
+		auxAddresses: auxAddresses,
+		ipAllocator:  ipAllocator,
+		ipamPool:     ipamPool,
+		global:       global,
+		mesh:         mesh,
+		meshPeers:    make(map[string]*WgPeer, 0),
+		vxlan:        vxlan,
+		addedPeers:   make(map[string]*WgPeer, 0),
+		wgEndpoint:   wgEndpoint,
+		outboundAddr: outboundAddr,
+		outboundIntf: outboundIntf,
+		iptables:     iptables,
+		endpoints:    endpoints,
+		peerStatus:   make(map[string]*PeerStatus, 0),
+		stop:         make(chan struct{}),
+	}
+
+	network.startBackground(rotation, monitor, mesh)
+	network.saveState(lg)
+
+	return network, nil
+}
+
+func (t *Network) startBackground(rotation *RotationPolicy, monitor *MonitorPolicy, mesh *MeshPolicy) {
+	if rotation != nil {
+		t.background.Add(1)
+		go t.rotationLoop(rotation)
+	}
+	if monitor != nil {
+		t.background.Add(1)
+		go t.monitorLoop(monitor)
+	}
+	if mesh != nil {
+		t.background.Add(1)
+		go t.meshLoop(mesh)
+	}
 }
 
 func (t *Network) Delete() error {
+	close(t.stop)
+	t.background.Wait()
+	// Waits out an endpoint update that started before the stop
+	t.forwardingMu.Lock()
+	defer t.forwardingMu.Unlock()
+
+	if t.mesh != nil {
+		if err := withdrawMeshEntry(t.mesh, t.PublicKey()); err != nil {
+			t.log.Warn("Failed to remove entry from the registry", "registry", t.mesh.Registry, "error", err)
+		}
+	}
+
 	t.nl.Delete()
 
 	err := deleteNs(t.ns, t.name)
@@ -195,80 +405,283 @@ func (t *Network) Delete() error {
 
 	t.rootNl.Delete()
 
-	err = t.iptables.RemoveForwarding(t.rootNs, t.outboundAddr, t.wgEndpoint, t.conf.ListenPort)
-	return err
+	err = t.iptables.RemoveForwarding(t.rootNs, t.outboundAddr, t.endpointAddr(), t.conf.ListenPort)
+	if err != nil {
+		return err
+	}
+	return t.removeState()
 }
 
-func (t *Network) CreateEndpoint(id string, intf *network.EndpointInterface) (*network.EndpointInterface, error) {
-	if _, ok := t.endpoints[id]; ok {
-		return nil, fmt.Errorf("Endpoint with this id already exists: %v", id)
+func (t *Network) saveState(lg *Logger) {
+	if err := t.SaveState(); err != nil {
+		lg.Warn("Failed to save network state", "error", err)
 	}
+}
+
+func (t *Network) PublicKey() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.publicKey
+}
+
+func (t *Network) wgInterface() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wgLink.Attrs().Name
+}
+
+func (t *Network) peers() []*WgPeer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*WgPeer(nil), t.conf.Peers...)
+}
 
-	endpoint, err := CreateEndpoint(intf, t.ipAllocator)
+func (t *Network) CreateEndpoint(lg *Logger, id string, intf *network.EndpointInterface, options *Options) (*network.EndpointInterface, error) {
+	created := false
+	t.mu.Lock()
+	endpoint, err := t.endpoints.create(lg, id, intf, func() (*Endpoint, error) {
+		created = true
+		return CreateEndpoint(intf, t.ipAllocator, options.String("reservation"), t.ipamPool != "", t.options.Bool("mac_from_ip"))
+	})
+	t.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	t.endpoints[id] = endpoint
-
 	response := endpoint.CreateEndpointResponse()
-
-	log.Printf("Created endpoint with details: %v", response)
+	if created {
+		lg.Info("Created endpoint", "address", response.Address, "mac", response.MacAddress)
+		t.saveState(lg)
+	}
 
 	return response, nil
 }
 
-func (t *Network) DeleteEndpoint(id string) error {
-	endpoint, ok := t.endpoints[id]
-	if !ok {
-		return fmt.Errorf("Endpoint with this id not found: %v", id)
+func (t *Network) DeleteEndpoint(lg *Logger, id string) error {
+	t.mu.Lock()
+	endpoint, err := t.endpoints.remove(lg, id, &networkLinks{t, lg})
+	t.mu.Unlock()
+	if err != nil || endpoint == nil {
+		return err
 	}
 
-	t.ipAllocator.MarkUnused(endpoint.Addr.IP)
+	// The ipam driver releases its addresses itself
+	if t.ipamPool == "" {
+		t.ipAllocator.MarkUnused(endpoint.Addr.IP)
+	}
 
-	delete(t.endpoints, id)
+	lg.Info("Deleted endpoint", "address", endpoint.Addr)
+	t.saveState(lg)
 	return nil
 }
 
-func (t *Network) Join(endpointId string) (*network.JoinResponse, error) {
-	_, ok := t.endpoints[endpointId]
+// The netlink side of the endpoint transitions.
+type networkLinks struct {
+	network *Network
+	lg      *Logger
+}
+
+func (t *networkLinks) addLink(endpoint *Endpoint) (string, string, error) {
+	n := t.network
+	publicLinkName, internalLinkName, err := createContainerLink(n.ns, n.rootNs, n.nl, n.rootNl, n.bridge, endpoint.Mac, n.containerMTU())
+	if err != nil {
+		return "", "", err
+	}
+	if n.routed {
+		if err = routeContainerLink(n.ns, n.nl, internalLinkName, endpoint.Addr.IP); err != nil {
+			if link, linkErr := n.nl.LinkByName(internalLinkName); linkErr == nil {
+				n.nl.LinkDel(link)
+			}
+			return "", "", err
+		}
+	}
+	return publicLinkName, internalLinkName, nil
+}
+
+// Deletes the bridge side of a joined endpoint's veth, unless it already went
+// away with the sandbox.
+func (t *networkLinks) removeLink(endpoint *Endpoint) error {
+	link, err := t.network.nl.LinkByName(endpoint.Interface)
+	if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+		t.lg.Debug("Endpoint interface is already gone", "interface", endpoint.Interface)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	t.lg.Info("Deleting endpoint interface", "interface", endpoint.Interface)
+	return t.network.nl.LinkDel(link)
+}
+
+// Describes an endpoint for docker inspect.  Joined endpoints also report
+// their links and routes, and every endpoint reports the tunnel's peers.
+func (t *Network) EndpointInfo(lg *Logger, id string) (map[string]string, error) {
+	endpoint, ok := t.endpoints[id]
 	if !ok {
-		return nil, fmt.Errorf("Endpoint %s not found", endpointId)
+		return nil, fmt.Errorf("Endpoint %s not found", id)
+	}
+
+	info := make(map[string]string, 0)
+	info["publickey"] = t.PublicKey()
+	info["address"] = endpoint.Addr.String()
+	info["mac"] = endpoint.Mac.String()
+	if t.routed {
+		info["gateway_link"] = t.gateway.Attrs().Name
+	} else {
+		info["bridge"] = t.bridge.Attrs().Name
+	}
+	info["tunnel"] = t.wgInterface()
+	info["host_link"] = t.outboundIntf.Attrs().Name
+	if t.vxlan != nil {
+		info["vxlan"] = fmt.Sprintf("%s vni=%d mtu=%d", vxlanName, t.vxlan.VxlanId, t.vxlan.MTU)
+	}
+	info["status"] = string(endpoint.Status)
+	if endpoint.Status == EndpointJoined {
+		info["interface"] = endpoint.Interface
+		routes := t.containerRoutes()
+		strs := make([]string, len(routes))
+		for i, route := range routes {
+			strs[i] = route.Destination + " via " + route.NextHop
+		}
+		info["routes"] = strings.Join(strs, ", ")
+	}
+
+	// The monitor's last reading, running wg here would hold up every other
+	// request behind the driver lock
+	statuses := make(map[string]*PeerStatus, 0)
+	for _, status := range t.PeerStatus() {
+		statuses[status.PublicKey] = status
+	}
+	peers := t.peers()
+	info["peers"] = fmt.Sprint(len(peers))
+	for _, peer := range peers {
+		status, ok := statuses[peer.PublicKey]
+		if !ok {
+			info["peer."+peer.PublicKey] = fmt.Sprintf("endpoint=%s handshake=unknown", peer.Endpoint)
+			continue
+		}
+		handshake := "never"
+		if !status.LatestHandshake.IsZero() {
+			handshake = time.Since(status.LatestHandshake).Truncate(time.Second).String() + " ago"
+		}
+		info["peer."+peer.PublicKey] = fmt.Sprintf("endpoint=%s handshake=%s rx=%d tx=%d", status.Endpoint, handshake, status.RxBytes, status.TxBytes)
 	}
+	return info, nil
+}
 
-	publicLinkName, internalLinkName, err := createContainerLink(t.ns, t.rootNs, t.nl, t.rootNl, t.bridge)
+func (t *Network) Join(lg *Logger, endpointId, sandboxKey string) (*network.JoinResponse, error) {
+	t.mu.Lock()
+	endpoint, publicLinkName, err := t.endpoints.join(lg, endpointId, sandboxKey, &networkLinks{t, lg})
+	t.mu.Unlock()
 	if err != nil {
 		return nil, err
 	}
-	t.interfaces[endpointId] = internalLinkName
+	t.announceEndpoint(lg, endpoint, publicLinkName)
 
-	routes := t.conf.GetRoutes(t.bridgeNet.IP)
+	routes := t.containerRoutes()
 
 	response := &network.JoinResponse{
 		InterfaceName: network.InterfaceName{
 			SrcName:   publicLinkName,
-			DstPrefix: LINK_PREFIX,
+			DstPrefix: GetConfig().LinkPrefix,
 		},
 		StaticRoutes: routes,
 	}
 
-	str := spew.Sdump(*response)
-	log.Printf("Responding to join request: %s\n", str)
+	lg.Info("Joined endpoint", "interface", endpoint.Interface, "routes", len(routes))
+	t.saveState(lg)
 	return response, nil
 }
 
-func (t *Network) Leave(endpointId string) error {
-	interfaceName, ok := t.interfaces[endpointId]
-	if !ok {
-		return fmt.Errorf("Endpoint %s not found", endpointId)
+// Routes pushed into containers on join: the peers' networks and, in mesh
+// mode, the supernet covering hosts that are yet to join.
+func (t *Network) containerRoutes() []*network.StaticRoute {
+	t.mu.Lock()
+	routes := t.conf.GetRoutes(t.bridgeNet.IP)
+	t.mu.Unlock()
+	if t.mesh != nil && t.mesh.Supernet != nil {
+		routes = append(routes, &network.StaticRoute{
+			Destination: t.mesh.Supernet.String(),
+			RouteType:   0,
+			NextHop:     t.bridgeNet.IP.String(),
+		})
+	}
+	return routes
+}
+
+func (t *Network) Leave(lg *Logger, endpointId string) error {
+	t.mu.Lock()
+	left, err := t.endpoints.leave(lg, endpointId, &networkLinks{t, lg})
+	t.mu.Unlock()
+	if err != nil || !left {
+		return err
+	}
+	lg.Info("Left endpoint")
+	t.saveState(lg)
+	return nil
+}
+
+// A container coming back with the same address may have a new mac address.
+// Points the namespace's neighbour entry at it and sends a gratuitous arp from
+// it so other containers don't keep sending to the old one.
+// Failures only delay the update until the stale entries expire.
+func (t *Network) announceEndpoint(lg *Logger, endpoint *Endpoint, publicLinkName string) {
+	var neighLink netlink.Link = t.bridge
+	var err error
+	if t.routed {
+		neighLink, err = t.nl.LinkByName(endpoint.Interface)
+	}
+	if err == nil {
+		err = t.nl.NeighSet(&netlink.Neigh{
+			LinkIndex:    neighLink.Attrs().Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_STALE,
+			IP:           endpoint.Addr.IP,
+			HardwareAddr: endpoint.Mac,
+		})
+	}
+	if err != nil {
+		lg.Warn("Failed to update neighbour entry", "address", endpoint.Addr.IP, "error", err)
+	}
+
+	link, err := t.rootNl.LinkByName(publicLinkName)
+	if err == nil {
+		err = sendGratuitousArp(t.rootNs, link, endpoint.Addr.IP, endpoint.Mac)
+	}
+	if err != nil {
+		lg.Warn("Failed to send gratuitous arp", "address", endpoint.Addr.IP, "error", err)
+		return
+	}
+	lg.Debug("Announced endpoint address", "address", endpoint.Addr.IP, "mac", endpoint.Mac)
+}
+
+// Applies the parts of the interface configuration that the driver manages on
+// top of what wg-quick sets up from the config file.
+func configureInterface(lg *Logger, ns netns.NsHandle, intf string, conf *WgConfig, peers []*WgPeer, keyPath, stateDir, id string) error {
+	if !conf.HasPrivateKey {
+		if _, err := LoadOrCreateKey(lg, keyPath); err != nil {
+			return err
+		}
+		_, err := wgCommand(ns, "", "set", intf, "private-key", keyPath)
+		if err != nil {
+			return err
+		}
+		lg.Info("Configured wireguard interface with managed key", "path", keyPath)
+	}
+
+	exportedPeers, err := loadExportedPeers(exportedPeersPath(stateDir, id))
+	if err != nil {
+		return err
+	}
+	err = applyExportedPeers(ns, intf, exportedPeers)
+	if err != nil {
+		return fmt.Errorf("Failed to add exported peers: %v", err)
 	}
-	delete(t.endpoints, endpointId)
 
-	link, err := t.nl.LinkByName(interfaceName)
+	err = applyStoredPresharedKeys(ns, intf, pskDir(stateDir, id), peers)
 	if err != nil {
-		return fmt.Errorf("Failed to delete interface, interface not found")
+		return fmt.Errorf("Failed to apply stored preshared keys: %v", err)
 	}
-	return t.nl.LinkDel(link)
+	return nil
 }
 
 func deleteNs(ns netns.NsHandle, name *string) error {
@@ -330,39 +743,8 @@ func allLinkNets(nsHandle *netlink.Handle) ([]net.IPNet, error) {
 	return nets, nil
 }
 
-func checkUnused(addr net.IP, used []net.IPNet) bool {
-	for _, net := range used {
-		if net.Contains(addr) {
-			return false
-		}
-	}
-	return true
-}
-
-// Use 17.31.X.X.  Maybe this should be configurable later but this is fine for now.
-func findUnusedAddresses(nsHandle *netlink.Handle) (net.IP, net.IP, error) {
-	nets, err := allLinkNets(nsHandle)
-	if err != nil {
-		return nil, nil, err
-	}
-	for i := 0; i < 65536; i += 2 {
-		ip1 := net.IPv4(172, 31, byte(i/256), byte(i%256))
-		ip2 := net.IPv4(172, 31, byte(i/256), byte((i%256)+1))
-
-		if checkUnused(ip1, nets) && checkUnused(ip2, nets) {
-			return ip1, ip2, nil
-		}
-	}
-	return nil, nil, fmt.Errorf("Unable to find unused address")
-}
-
-func createOutboundLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle) (net.IP, netlink.Link, error) {
-	publicName, err := findUnusedLinkName(LINK_PREFIX, rootNl)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	ip1, ip2, err := findUnusedAddresses(rootNl)
+func createOutboundLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle, ip1, ip2 net.IP) (net.IP, netlink.Link, error) {
+	publicName, err := findUnusedLinkName(GetConfig().LinkPrefix, rootNl)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -433,8 +815,11 @@ func createOutboundLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle) (
 	return ip2, veth, nil
 }
 
-func createContainerLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle, bridge *netlink.Bridge) (string, string, error) {
-	publicName, err := findUnusedLinkName(LINK_PREFIX, rootNl)
+// The container side of the veth gets the endpoint's mac address right away,
+// rather than only once docker moves it into the sandbox.  An mtu of 0 keeps
+// the default, and without a bridge the veth is left unattached.
+func createContainerLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle, bridge *netlink.Bridge, mac net.HardwareAddr, mtu int) (string, string, error) {
+	publicName, err := findUnusedLinkName(GetConfig().LinkPrefix, rootNl)
 	if err != nil {
 		return "", "", err
 	}
@@ -445,8 +830,10 @@ func createContainerLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle,
 
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
-			Name:      publicName,
-			Namespace: netlink.NsFd(rootNs),
+			Name:         publicName,
+			Namespace:    netlink.NsFd(rootNs),
+			HardwareAddr: mac,
+			MTU:          mtu,
 		},
 		PeerName: innerName,
 	}
@@ -464,9 +851,11 @@ func createContainerLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle,
 	if err != nil {
 		return "", "", err
 	}
-	err = nl.LinkSetMaster(innerLink, bridge)
-	if err != nil {
-		return "", "", err
+	if bridge != nil {
+		err = nl.LinkSetMaster(innerLink, bridge)
+		if err != nil {
+			return "", "", err
+		}
 	}
 	err = nl.LinkSetUp(innerLink)
 	if err != nil {
@@ -476,10 +865,98 @@ func createContainerLink(ns, rootNs netns.NsHandle, nl, rootNl *netlink.Handle,
 	return publicName, innerName, nil
 }
 
+// Sets up the allocator for container addresses according to the network's
+// ip_range, exclude, reservations and reuse_delay options.
+func createNetworkAllocator(subnet *net.IPNet, options *Options) (*IpAllocator, error) {
+	ipAllocator, err := CreateIpAllocator(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ipAllocator.reuseDelay = options.Duration("reuse_delay")
+
+	if options.IsSet("ip_range") {
+		_, ipRange, _ := net.ParseCIDR(options.String("ip_range"))
+		if err = ipAllocator.SetRange(ipRange); err != nil {
+			return nil, err
+		}
+	}
+	if options.IsSet("exclude") {
+		excluded, _ := parseAddressList(options.String("exclude"))
+		for _, n := range excluded {
+			ipAllocator.Exclude(n)
+		}
+	}
+	if options.IsSet("reservations") {
+		reservations, _ := parseReservations(options.String("reservations"))
+		for name, ip := range reservations {
+			if err = ipAllocator.Reserve(name, ip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ipAllocator, nil
+}
+
+// The bridge takes the gateway docker's ipam picked, or the first free address
+// if it did not pick one.  Gateways from a shared pool are already marked used.
+func gatewayAddress(data *network.IPAMData, subnet *net.IPNet, conf *WgConfig, ipAllocator *IpAllocator, shared bool) (*net.IPNet, error) {
+	if data.Gateway == "" {
+		bridgeNet, err := ipAllocator.FindAddress()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find address for bridge: %v", err)
+		}
+		return bridgeNet, nil
+	}
+
+	ip, _, err := net.ParseCIDR(data.Gateway)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gateway %s: %v", data.Gateway, err)
+	}
+	if !subnet.Contains(ip) {
+		return nil, fmt.Errorf("Gateway %s is outside of the pool %s", ip, subnet)
+	}
+	if ip.Equal(conf.Net.IP) {
+		return nil, fmt.Errorf("Gateway %s is the wireguard address from %s", ip, conf.Path)
+	}
+	if !shared && ipAllocator.IsUsed(ip) {
+		return nil, fmt.Errorf("Gateway %s is already reserved as an auxiliary address", ip)
+	}
+	ipAllocator.MarkUsed(ip)
+	return &net.IPNet{IP: ip, Mask: subnet.Mask}, nil
+}
+
+// Keeps the auxiliary addresses given to docker network create out of the
+// allocator.
+func reserveAuxAddresses(data *network.IPAMData, subnet *net.IPNet, conf *WgConfig, ipAllocator *IpAllocator) (map[string]net.IP, error) {
+	aux := make(map[string]net.IP, len(data.AuxAddresses))
+	for name, val := range data.AuxAddresses {
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected type %T for auxiliary address %s", val, name)
+		}
+		ip := net.ParseIP(str)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(str); err != nil {
+				return nil, fmt.Errorf("Invalid auxiliary address %s=%s", name, str)
+			}
+		}
+		if !subnet.Contains(ip) {
+			return nil, fmt.Errorf("Auxiliary address %s=%s is outside of the pool %s", name, ip, subnet)
+		}
+		if ip.Equal(conf.Net.IP) {
+			return nil, fmt.Errorf("Auxiliary address %s=%s is the wireguard address from %s", name, ip, conf.Path)
+		}
+		ipAllocator.MarkUsed(ip)
+		aux[name] = ip
+	}
+	return aux, nil
+}
+
 func createBridge(nl *netlink.Handle, net *net.IPNet) (*netlink.Bridge, error) {
 	bridge := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: "br0",
+			Name: GetConfig().BridgeName,
 		},
 	}
 
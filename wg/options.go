@@ -0,0 +1,289 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type OptionType string
+
+const (
+	OptionString   OptionType = "string"
+	OptionPath     OptionType = "path"
+	OptionBool     OptionType = "bool"
+	OptionDuration OptionType = "duration"
+
+	genericOptions = "com.docker.network.generic"
+)
+
+type Option struct {
+	Name        string
+	Type        OptionType
+	Default     string
+	Required    bool
+	Description string
+	// Extra checks on top of the ones implied by the type
+	Validate func(value string) error `json:"-"`
+}
+
+func (t *Option) parse(value string) error {
+	var err error
+	switch t.Type {
+	case OptionString, OptionPath:
+		if value == "" {
+			err = fmt.Errorf("must not be empty")
+		}
+	case OptionBool:
+		_, err = strconv.ParseBool(value)
+	case OptionDuration:
+		var duration time.Duration
+		duration, err = time.ParseDuration(value)
+		if err == nil && duration < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	}
+	if err == nil && t.Validate != nil {
+		err = t.Validate(value)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value %q for option %s: %v", value, t.Name, err)
+	}
+	return nil
+}
+
+func validateNamespaceName(value string) error {
+	if strings.ContainsAny(value, "/\x00") || value == "." || value == ".." {
+		return fmt.Errorf("not a valid namespace name")
+	}
+	return nil
+}
+
+var NetworkOptions = []*Option{
+	{Name: "wgconf", Type: OptionPath, Required: true, Description: "wg-quick config file for the tunnel"},
+	{Name: "endpoint", Type: OptionString, Required: true, Description: "host address the tunnel is reachable on: an ip address, an interface to take it from or auto for the default route's", Validate: validateEndpoint},
+	{Name: "keyfile", Type: OptionPath, Description: "private key file, generated if missing, defaults to one in the state directory"},
+	{Name: "namespace", Type: OptionString, Description: "name for the network namespace, generated if unset", Validate: validateNamespaceName},
+	{Name: "transit_range", Type: OptionString, Description: "range to pick the /31 linking the namespace to the host from, defaults to the daemon's transit_range", Validate: validateTransitRange},
+	{Name: "ip_range", Type: OptionString, Description: "part of the subnet to allocate container addresses from", Validate: validateCIDR},
+	{Name: "exclude", Type: OptionString, Description: "comma separated addresses or ranges never to allocate", Validate: validateAddressList},
+	{Name: "reservations", Type: OptionString, Description: "comma separated name=address pairs, used by endpoints with the reservation option", Validate: validateReservations},
+	{Name: "reuse_delay", Type: OptionDuration, Default: defaultReuseDelay.String(), Description: "time a released address is held back before being allocated again"},
+	{Name: "tunnel_range", Type: OptionString, Description: "global scope: range node tunnel addresses are taken from, defaults to " + defaultGlobalTunnelRange, Validate: validateCIDR},
+	{Name: "listen_port", Type: OptionString, Description: "global scope: port nodes listen on, defaults to " + defaultGlobalListenPort, Validate: validatePort},
+	{Name: "global_secret_file", Type: OptionPath, Description: "global scope: file holding the base64 secret node keys are derived from, the same on every node"},
+	{Name: "registry", Type: OptionPath, Description: "mesh mode: shared directory hosts publish their tunnel and subnet to and take their peers from"},
+	{Name: "mesh_network", Type: OptionString, Default: defaultMeshNetwork, Description: "mesh mode: name every host gives the mesh, separating meshes that share a registry", Validate: validateMeshNetwork},
+	{Name: "registry_interval", Type: OptionDuration, Default: defaultMeshInterval.String(), Description: "mesh mode: interval to publish to and reconcile with the registry at"},
+	{Name: "mesh_supernet", Type: OptionString, Description: "mesh mode: range covering every host's subnet, routed into containers so hosts joining later are reachable", Validate: validateCIDR},
+	{Name: "mac_from_ip", Type: OptionBool, Default: "false", Description: "derive container mac addresses from their ip like docker's bridge driver instead of picking random ones"},
+	{Name: "routed", Type: OptionBool, Default: "false", Description: "route each container over its own veth instead of attaching it to a bridge"},
+	{Name: "vxlan", Type: OptionBool, Default: "false", Description: "extend the bridge to every peer's bridge with vxlan over the tunnel, so the subnet spans hosts at layer 2, always on in global scope"},
+	{Name: "vxlan_id", Type: OptionString, Default: defaultVxlanId, Description: "vxlan: network identifier, the same on every host", Validate: validateVxlanId},
+	{Name: "vxlan_port", Type: OptionString, Default: defaultVxlanPort, Description: "vxlan: udp port inside the tunnel", Validate: validatePort},
+	{Name: "cleanup", Type: OptionBool, Default: "true", Description: "delete the namespace if creating the network fails"},
+	{Name: "masquerade", Type: OptionBool, Default: "false", Description: "hide the container subnet behind the tunnel address"},
+	{Name: "rotate_psk", Type: OptionDuration, Default: "0s", Description: "interval to rotate preshared keys at, 0 disables rotation"},
+	{Name: "rotation_grace", Type: OptionDuration, Default: defaultRotationGrace.String(), Description: "time between staging and applying rotated keys"},
+	{Name: "rotate_key", Type: OptionBool, Default: "false", Description: "also rotate the interface private key"},
+	{Name: "rotation_hook", Type: OptionPath, Description: "command run when keys are staged and applied"},
+	{Name: "monitor_interval", Type: OptionDuration, Default: defaultMonitorInterval.String(), Description: "interval to check peer health at, 0 disables monitoring"},
+	{Name: "handshake_timeout", Type: OptionDuration, Default: defaultHandshakeTimeout.String(), Description: "handshake age after which a peer is considered stale"},
+	{Name: "recovery_timeout", Type: OptionDuration, Default: defaultRecoveryTimeout.String(), Description: "time a peer may stay stale before the interface is restarted"},
+}
+
+var EndpointOptions = []*Option{
+	{Name: "reservation", Type: OptionString, Description: "name of the network's reservation to take the address from"},
+}
+
+func validateCIDR(val string) error {
+	_, _, err := net.ParseCIDR(val)
+	return err
+}
+
+// Addresses or ranges, separated by commas.
+func parseAddressList(val string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if ip := net.ParseIP(item); ip != nil {
+			nets = append(nets, hostNet(ip))
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a range", item)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func validateAddressList(val string) error {
+	_, err := parseAddressList(val)
+	return err
+}
+
+// Name and address pairs like web=10.0.0.10, separated by commas.
+func parseReservations(val string) (map[string]net.IP, error) {
+	reservations := make(map[string]net.IP, 0)
+	for _, item := range strings.Split(val, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form name=address", item)
+		}
+		ip := net.ParseIP(parts[1])
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", parts[1])
+		}
+		if _, ok := reservations[parts[0]]; ok {
+			return nil, fmt.Errorf("%s is reserved twice", parts[0])
+		}
+		reservations[parts[0]] = ip
+	}
+	return reservations, nil
+}
+
+func validateReservations(val string) error {
+	_, err := parseReservations(val)
+	return err
+}
+
+func findOption(schema []*Option, name string) *Option {
+	for _, option := range schema {
+		if option.Name == name {
+			return option
+		}
+	}
+	return nil
+}
+
+func optionNames(schema []*Option) string {
+	names := make([]string, len(schema))
+	for i, option := range schema {
+		names[i] = option.Name
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Option values after validation, with defaults filled in.
+type Options struct {
+	values map[string]string
+}
+
+// Options come in as json, so accept numbers and booleans as well as
+// strings.
+func optionString(name string, val interface{}) (string, error) {
+	switch val := val.(type) {
+	case string:
+		return val, nil
+	case bool:
+		return strconv.FormatBool(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("Option %s must be a string, got %T", name, val)
+	}
+}
+
+func parseOptions(kind string, schema []*Option, raw map[string]interface{}) (*Options, error) {
+	values := make(map[string]string, len(schema))
+	for name, val := range raw {
+		option := findOption(schema, name)
+		if option == nil {
+			return nil, fmt.Errorf("Unknown %s option %q, valid options are: %s", kind, name, optionNames(schema))
+		}
+		str, err := optionString(name, val)
+		if err != nil {
+			return nil, err
+		}
+		if err = option.parse(str); err != nil {
+			return nil, err
+		}
+		values[name] = str
+	}
+
+	for _, option := range schema {
+		if _, ok := values[option.Name]; ok {
+			continue
+		}
+		if option.Required {
+			return nil, fmt.Errorf("Missing required %s option %s: %s", kind, option.Name, option.Description)
+		}
+		if option.Default != "" {
+			values[option.Name] = option.Default
+		}
+	}
+	return &Options{values}, nil
+}
+
+func ParseNetworkOptions(raw map[string]interface{}) (*Options, error) {
+	return parseOptions("network", NetworkOptions, raw)
+}
+
+// Endpoint options share the map with docker's own com.docker.* labels, which
+// are not ours to check.
+func ParseEndpointOptions(raw map[string]interface{}) (*Options, error) {
+	options := make(map[string]interface{}, 0)
+	if generic, ok := raw[genericOptions].(map[string]interface{}); ok {
+		for name, val := range generic {
+			options[name] = val
+		}
+	}
+	for name, val := range raw {
+		if !strings.HasPrefix(name, "com.docker.") {
+			options[name] = val
+		}
+	}
+	return parseOptions("endpoint", EndpointOptions, options)
+}
+
+// Checks option values without requiring the mandatory ones, for defaults
+// that are merged in later.
+func validateOptionValues(kind string, schema []*Option, values map[string]string) error {
+	for name, val := range values {
+		option := findOption(schema, name)
+		if option == nil {
+			return fmt.Errorf("Unknown %s option %q, valid options are: %s", kind, name, optionNames(schema))
+		}
+		if err := option.parse(val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Options) IsSet(name string) bool {
+	_, ok := t.values[name]
+	return ok
+}
+
+func (t *Options) String(name string) string {
+	return t.values[name]
+}
+
+func (t *Options) Bool(name string) bool {
+	val, _ := strconv.ParseBool(t.values[name])
+	return val
+}
+
+func (t *Options) Duration(name string) time.Duration {
+	val, _ := time.ParseDuration(t.values[name])
+	return val
+}
+
+// The values as given and defaulted, in the form docker passes them in.
+func (t *Options) Raw() map[string]interface{} {
+	raw := make(map[string]interface{}, len(t.values))
+	for name, val := range t.values {
+		raw[name] = val
+	}
+	return raw
+}
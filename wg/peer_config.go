@@ -0,0 +1,317 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// A peer created through export-peer.  Only the public half of its key is ever
+// stored on this host.
+type ExportedPeer struct {
+	PublicKey string
+	Address   *net.IPNet
+}
+
+type PeerConfigResponse struct {
+	NetworkID string
+	PeerBlock string
+}
+
+type NewPeerResponse struct {
+	NetworkID     string
+	PublicKey     string
+	Address       string
+	Config        string
+	HostPeerBlock string
+}
+
+func exportedPeersPath(stateDir, networkId string) string {
+	return filepath.Join(stateDir, "peers", networkId+".json")
+}
+
+func loadExportedPeers(path string) ([]*ExportedPeer, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var peers []*ExportedPeer
+	if err = json.Unmarshal(contents, &peers); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return peers, nil
+}
+
+func saveExportedPeers(path string, peers []*ExportedPeer) error {
+	return writeFileAtomic(path, peers)
+}
+
+func (t *ExportedPeer) WgPeer() *WgPeer {
+	return &WgPeer{
+		PublicKey:  t.PublicKey,
+		AllowedIPs: []*net.IPNet{hostNet(t.Address.IP)},
+	}
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+func joinNets(nets []*net.IPNet) string {
+	strs := make([]string, len(nets))
+	for i, n := range nets {
+		strs[i] = n.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// The networks reachable through this host, from the remote side's point of view.
+func (t *Network) exportedAllowedIPs() []*net.IPNet {
+	allowed := []*net.IPNet{hostNet(t.conf.Net.IP)}
+	if !t.masquerade {
+		allowed = append(allowed, t.subnet)
+	}
+	return allowed
+}
+
+func (t *Network) PeerBlock() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Peer]\n")
+	fmt.Fprintf(&b, "# wg-docker-net network %s\n", t.id)
+	fmt.Fprintf(&b, "PublicKey = %s\n", t.PublicKey())
+	fmt.Fprintf(&b, "Endpoint = %s\n", net.JoinHostPort(t.endpointAddr().String(), fmt.Sprint(t.conf.ListenPort)))
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", joinNets(t.exportedAllowedIPs()))
+	return b.String()
+}
+
+func (t *Network) findPeerAddress() (*net.IPNet, error) {
+	allocator, err := CreateIpAllocator(t.conf.Net)
+	if err != nil {
+		return nil, err
+	}
+	allocator.MarkUsed(t.conf.Net.IP)
+
+	markPeerAddresses(allocator, t.conf.Net, t.peers())
+	return allocator.FindAddress()
+}
+
+func (t *Network) hasPeer(publicKey string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, peer := range t.conf.Peers {
+		if peer.PublicKey == publicKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a peer to the running interface or updates it, and routes the parts of
+// its allowed ips outside of the tunnel subnet to the interface.
+func (t *Network) setPeer(peer *WgPeer) error {
+	allowed := make([]string, len(peer.AllowedIPs))
+	for i, n := range peer.AllowedIPs {
+		allowed[i] = n.String()
+	}
+	args := []string{"set", t.wgInterface(), "peer", peer.PublicKey}
+	if peer.Endpoint != "" {
+		args = append(args, "endpoint", peer.Endpoint)
+	}
+	args = append(args, "allowed-ips", strings.Join(allowed, ","))
+	if _, err := wgCommand(t.ns, "", args...); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	link := t.wgLink
+	var previous *WgPeer
+	peers := make([]*WgPeer, 0, len(t.conf.Peers)+1)
+	for _, other := range t.conf.Peers {
+		if other.PublicKey == peer.PublicKey {
+			previous = other
+		} else {
+			peers = append(peers, other)
+		}
+	}
+	t.setPeersLocked(append(peers, peer))
+	t.addedPeers[peer.PublicKey] = peer
+	t.mu.Unlock()
+
+	if previous != nil {
+		if err := t.updateFloodEntries(previous, true); err != nil {
+			return err
+		}
+	}
+	if err := t.updateFloodEntries(peer, false); err != nil {
+		return err
+	}
+
+	for _, n := range peer.AllowedIPs {
+		if t.conf.Net.Contains(n.IP) {
+			continue
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: n}
+		if err := t.nl.RouteReplace(route); err != nil {
+			return fmt.Errorf("Failed to route %s to the tunnel: %v", n, err)
+		}
+	}
+	return nil
+}
+
+func (t *Network) removePeer(publicKey string) error {
+	if _, err := wgCommand(t.ns, "", "set", t.wgInterface(), "peer", publicKey, "remove"); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	link := t.wgLink
+	var removed *WgPeer
+	peers := make([]*WgPeer, 0, len(t.conf.Peers))
+	for _, other := range t.conf.Peers {
+		if other.PublicKey == publicKey {
+			removed = other
+		} else {
+			peers = append(peers, other)
+		}
+	}
+	t.setPeersLocked(peers)
+	delete(t.addedPeers, publicKey)
+	delete(t.peerStatus, publicKey)
+	t.mu.Unlock()
+
+	if removed == nil {
+		return nil
+	}
+	if err := t.updateFloodEntries(removed, true); err != nil {
+		return err
+	}
+	for _, n := range removed.AllowedIPs {
+		if t.conf.Net.Contains(n.IP) {
+			continue
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: n}
+		if err := t.nl.RouteDel(route); err != nil && !os.IsNotExist(err) && err != syscall.ESRCH {
+			return fmt.Errorf("Failed to remove route to %s: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// Sets the peers added at runtime again, after the interface was reset to its
+// config file.
+func (t *Network) restoreAddedPeers() error {
+	t.mu.Lock()
+	peers := make([]*WgPeer, 0, len(t.addedPeers))
+	for _, peer := range t.addedPeers {
+		peers = append(peers, peer)
+	}
+	t.mu.Unlock()
+	for _, peer := range peers {
+		if err := t.setPeer(peer); err != nil {
+			return fmt.Errorf("Failed to restore peer %s: %v", peer.PublicKey, err)
+		}
+	}
+	return nil
+}
+
+// Callers hold mu.
+func (t *Network) setPeersLocked(peers []*WgPeer) {
+	peerNets := make([]*net.IPNet, 0, len(peers))
+	for _, peer := range peers {
+		peerNets = append(peerNets, peer.AllowedIPs...)
+	}
+	t.conf.Peers = peers
+	t.conf.PeerNets = peerNets
+}
+
+func applyExportedPeers(ns netns.NsHandle, intf string, peers []*ExportedPeer) error {
+	args := []string{"set", intf}
+	for _, peer := range peers {
+		args = append(args, "peer", peer.PublicKey, "allowed-ips", hostNet(peer.Address.IP).String())
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	_, err := wgCommand(ns, "", args...)
+	return err
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := uintToBytes(bytesToUint(ip.To4()) + 1)
+	if bytesToUint(next) == 0 {
+		return net.IPv4bcast
+	}
+	return next
+}
+
+// Generates a keypair and tunnel address for a new remote peer, adds it to the
+// running interface and returns a complete wg-quick config for it.
+func (t *Network) CreatePeer() (*NewPeerResponse, error) {
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+
+	address, err := t.findPeerAddress()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to allocate tunnel address for peer: %v", err)
+	}
+
+	privateKey, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := PublicKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &ExportedPeer{publicKey, address}
+	_, err = wgCommand(t.ns, "", "set", t.wgInterface(), "peer", publicKey, "allowed-ips", hostNet(address.IP).String())
+	if err != nil {
+		return nil, err
+	}
+
+	path := exportedPeersPath(t.stateDir, t.id)
+	peers, err := loadExportedPeers(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = saveExportedPeers(path, append(peers, peer)); err != nil {
+		return nil, fmt.Errorf("Added peer but failed to persist it: %v", err)
+	}
+	wgPeer := peer.WgPeer()
+	t.mu.Lock()
+	t.conf.Peers = append(t.conf.Peers, wgPeer)
+	t.conf.PeerNets = append(t.conf.PeerNets, wgPeer.AllowedIPs...)
+	t.mu.Unlock()
+	t.log.Info("Added exported peer", "peer", publicKey, "address", address)
+
+	var config strings.Builder
+	fmt.Fprintf(&config, "[Interface]\n")
+	fmt.Fprintf(&config, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&config, "Address = %s\n\n", address)
+	fmt.Fprintf(&config, "%s", t.PeerBlock())
+	fmt.Fprintf(&config, "PersistentKeepalive = 25\n")
+
+	var hostBlock strings.Builder
+	fmt.Fprintf(&hostBlock, "[Peer]\n")
+	fmt.Fprintf(&hostBlock, "PublicKey = %s\n", publicKey)
+	fmt.Fprintf(&hostBlock, "AllowedIPs = %s\n", hostNet(address.IP))
+
+	return &NewPeerResponse{
+		NetworkID:     t.id,
+		PublicKey:     publicKey,
+		Address:       address.String(),
+		Config:        config.String(),
+		HostPeerBlock: hostBlock.String(),
+	}, nil
+}
@@ -0,0 +1,233 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netns"
+)
+
+const (
+	defaultRotationGrace = 5 * time.Minute
+)
+
+type RotationPolicy struct {
+	Interval  time.Duration
+	Grace     time.Duration
+	RotateKey bool
+	Hook      string
+}
+
+type RotatedPeer struct {
+	PublicKey    string
+	PresharedKey string
+}
+
+// Written to the state directory and handed to the rotation hook so the remote
+// side can be updated before the new keys are applied locally.
+type Rotation struct {
+	NetworkID         string
+	Interface         string
+	Stage             string
+	PublicKey         string
+	PreviousPublicKey string
+	ApplyAt           time.Time
+	Peers             []RotatedPeer
+}
+
+func ParseRotationPolicy(options *Options) (*RotationPolicy, error) {
+	interval := options.Duration("rotate_psk")
+	if interval == 0 {
+		return nil, nil
+	}
+	grace := options.Duration("rotation_grace")
+	if grace >= interval {
+		return nil, fmt.Errorf("rotation_grace (%v) must be shorter than rotate_psk (%v)", grace, interval)
+	}
+	return &RotationPolicy{interval, grace, options.Bool("rotate_key"), options.String("rotation_hook")}, nil
+}
+
+func pskDir(stateDir, networkId string) string {
+	return filepath.Join(stateDir, "keys", networkId)
+}
+
+func pskPath(dir, publicKey string) string {
+	name := strings.NewReplacer("/", "_", "+", "-", "=", "").Replace(publicKey)
+	return filepath.Join(dir, name+".psk")
+}
+
+// Applies any preshared keys previously written to the secret store, so that
+// rotated keys survive the interface being brought up again from its config.
+func applyStoredPresharedKeys(ns netns.NsHandle, intf, dir string, peers []*WgPeer) error {
+	args := []string{"set", intf}
+	for _, peer := range peers {
+		path := pskPath(dir, peer.PublicKey)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		args = append(args, "peer", peer.PublicKey, "preshared-key", path)
+	}
+	if len(args) == 2 {
+		return nil
+	}
+	_, err := wgCommand(ns, "", args...)
+	return err
+}
+
+func (t *Network) rotationLoop(policy *RotationPolicy) {
+	defer t.background.Done()
+
+	t.log.Info("Rotating keys periodically", "interval", policy.Interval, "grace", policy.Grace, "rotate_key", policy.RotateKey)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(policy.Interval - policy.Grace):
+		}
+
+		if err := t.rotateKeys(policy); err != nil {
+			t.log.Error("Key rotation failed", "error", err)
+		}
+	}
+}
+
+func (t *Network) rotateKeys(policy *RotationPolicy) error {
+	intf := t.wgInterface()
+	dir := pskDir(t.stateDir, t.id)
+	if err := os.MkdirAll(dir, keyDirMode); err != nil {
+		return err
+	}
+
+	rotation := &Rotation{
+		NetworkID:         t.id,
+		Interface:         intf,
+		Stage:             "staged",
+		PublicKey:         t.PublicKey(),
+		PreviousPublicKey: t.PublicKey(),
+		ApplyAt:           time.Now().Add(policy.Grace),
+		Peers:             make([]RotatedPeer, 0),
+	}
+
+	staged := make([]string, 0)
+	defer func() {
+		for _, path := range staged {
+			os.Remove(path)
+		}
+	}()
+
+	args := []string{"set", intf}
+	var stagedKeyPath string
+	if policy.RotateKey {
+		key, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		if rotation.PublicKey, err = PublicKey(key); err != nil {
+			return err
+		}
+		stagedKeyPath = t.keyPath + ".staged"
+		if err = WriteKeyFile(stagedKeyPath, key); err != nil {
+			return err
+		}
+		staged = append(staged, stagedKeyPath)
+		args = append(args, "private-key", stagedKeyPath)
+	}
+
+	for _, peer := range t.peers() {
+		psk, err := wgTool("", "genpsk")
+		if err != nil {
+			return err
+		}
+		path := pskPath(dir, peer.PublicKey) + ".staged"
+		if err = WriteKeyFile(path, psk); err != nil {
+			return err
+		}
+		staged = append(staged, path)
+		rotation.Peers = append(rotation.Peers, RotatedPeer{peer.PublicKey, psk})
+		args = append(args, "peer", peer.PublicKey, "preshared-key", path)
+	}
+
+	if err := t.runRotationHook(policy, rotation); err != nil {
+		return fmt.Errorf("Rotation hook failed, keeping current keys: %v", err)
+	}
+	t.log.Info("Staged key rotation", "apply_at", rotation.ApplyAt)
+
+	select {
+	case <-t.stop:
+		return fmt.Errorf("Network deleted before rotation was applied")
+	case <-time.After(policy.Grace):
+	}
+
+	// All keys go to the interface in a single wg invocation so peers never see
+	// a half rotated configuration.
+	if _, err := wgCommand(t.ns, "", args...); err != nil {
+		return err
+	}
+
+	for _, path := range staged {
+		if err := os.Rename(path, strings.TrimSuffix(path, ".staged")); err != nil {
+			return fmt.Errorf("Applied rotated keys but failed to store them: %v", err)
+		}
+	}
+	staged = staged[:0]
+
+	t.mu.Lock()
+	t.publicKey = rotation.PublicKey
+	t.lastRotation = time.Now()
+	t.mu.Unlock()
+
+	rotation.Stage = "applied"
+	if err := t.runRotationHook(policy, rotation); err != nil {
+		t.log.Error("Rotation hook failed after applying keys", "error", err)
+	}
+	t.log.Info("Rotated keys", "public_key", rotation.PublicKey)
+	return nil
+}
+
+func (t *Network) runRotationHook(policy *RotationPolicy, rotation *Rotation) error {
+	if policy.Hook == "" {
+		return nil
+	}
+
+	contents, err := json.Marshal(rotation)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Join(t.stateDir, "keys"), ".rotation-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(policy.Hook)
+	cmd.Env = append(os.Environ(),
+		"WG_NETWORK_ID="+rotation.NetworkID,
+		"WG_INTERFACE="+rotation.Interface,
+		"WG_ROTATION_STAGE="+rotation.Stage,
+		"WG_PUBLIC_KEY="+rotation.PublicKey,
+		"WG_PREVIOUS_PUBLIC_KEY="+rotation.PreviousPublicKey,
+		"WG_ROTATION_FILE="+file.Name(),
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	t.log.Debug("Rotation hook finished", "stage", rotation.Stage, "output", string(output))
+	return nil
+}
@@ -0,0 +1,92 @@
+package wg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// In routed mode the namespace has no bridge.  The gateway address sits on a
+// dummy link and each container's veth is a point to point link with a host
+// route to the container.  The namespace side answers arp for the whole
+// subnet, so containers still see an ordinary subnet while everything between
+// them is routed and can be filtered per veth.
+
+const gatewayLinkName = "gw0"
+
+func createGatewayLink(nl *netlink.Handle, net *net.IPNet) (*netlink.Dummy, error) {
+	dummy := &netlink.Dummy{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: gatewayLinkName,
+		},
+	}
+	if err := nl.LinkAdd(dummy); err != nil {
+		return nil, fmt.Errorf("Failed to add gateway link: %v", err)
+	}
+	// The subnet route through the dummy drops traffic to addresses no
+	// container holds
+	if err := nl.AddrAdd(dummy, &netlink.Addr{IPNet: net}); err != nil {
+		return nil, fmt.Errorf("Failed to set address for gateway link: %v", err)
+	}
+	if err := nl.LinkSetUp(dummy); err != nil {
+		return nil, fmt.Errorf("Failed to set gateway link up: %v", err)
+	}
+	return dummy, nil
+}
+
+func writeSysctl(ns netns.NsHandle, path, value string) error {
+	return inNamespace(ns, func() error {
+		return ioutil.WriteFile(path, []byte(value), 0644)
+	})
+}
+
+// Makes the namespace side of a container's veth answer arp for the rest of
+// the subnet, without the usual delay for proxied replies, and routes the
+// container's address to it.
+func routeContainerLink(ns netns.NsHandle, nl *netlink.Handle, name string, addr net.IP) error {
+	link, err := nl.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	for path, value := range map[string]string{
+		filepath.Join("/proc/sys/net/ipv4/conf", name, "proxy_arp"):    "1",
+		filepath.Join("/proc/sys/net/ipv4/neigh", name, "proxy_delay"): "0",
+	} {
+		if err = writeSysctl(ns, path, value); err != nil {
+			return fmt.Errorf("Failed to enable proxy arp on %s: %v", name, err)
+		}
+	}
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       hostNet(addr),
+		Scope:     netlink.SCOPE_LINK,
+	}
+	if err = nl.RouteReplace(route); err != nil {
+		return fmt.Errorf("Failed to route %s to %s: %v", addr, name, err)
+	}
+	return nil
+}
+
+func (t *Network) routeCheck(id string, endpoint *Endpoint) *Check {
+	check := &Check{Name: fmt.Sprintf("endpoint %s is routed to %s", ShortId(id), endpoint.Interface)}
+	routes, err := t.nl.RouteGet(endpoint.Addr.IP)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	link, err := t.nl.LinkByName(endpoint.Interface)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Ok = len(routes) > 0 && routes[0].LinkIndex == link.Attrs().Index
+	if !check.Ok {
+		check.Detail = "no host route through the veth"
+		check.Fix = fmt.Sprintf("Add it with: ip -n <namespace> route replace %s dev %s", endpoint.Addr.IP, endpoint.Interface)
+	}
+	return check
+}
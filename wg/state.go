@@ -0,0 +1,476 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+type EndpointState struct {
+	Address    string
+	MacAddress string
+	Status     EndpointStatus `json:",omitempty"`
+	Interface  string
+	Sandbox    string
+}
+
+// Everything needed to take over a network left running by a previous
+// instance of the driver.
+type NetworkState struct {
+	ID                string
+	Namespace         string
+	Options           map[string]interface{}
+	Pool              string
+	IpamPool          string `json:",omitempty"`
+	Endpoint          string
+	OutboundInterface string
+	OutboundAddress   string
+	ListenPort        uint
+	Bridge            string
+	BridgeAddress     string
+	AuxAddresses      map[string]string
+	Endpoints         map[string]*EndpointState
+	MeshPeers         map[string]*MeshPeerState `json:",omitempty"`
+}
+
+type MeshPeerState struct {
+	Endpoint   string
+	AllowedIPs []string
+}
+
+// Writes v as json through a temporary file, so that a crash never leaves a
+// truncated file behind.
+func writeFileAtomic(path string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func networkStatePath(stateDir, id string) string {
+	return filepath.Join(stateDir, "networks", id+".json")
+}
+
+// Only networks in a named namespace survive the driver exiting, so state is
+// only kept for those.
+func (t *Network) persistent() bool {
+	return t.name != nil
+}
+
+func (t *Network) State() *NetworkState {
+	// Background loops save state without the driver lock
+	t.mu.Lock()
+	endpoints := make(map[string]*EndpointState, len(t.endpoints))
+	for id, endpoint := range t.endpoints {
+		endpoints[id] = &EndpointState{
+			Address:    endpoint.Addr.String(),
+			MacAddress: endpoint.Mac.String(),
+			Status:     endpoint.Status,
+			Interface:  endpoint.Interface,
+			Sandbox:    endpoint.Sandbox,
+		}
+	}
+	t.mu.Unlock()
+	return &NetworkState{
+		ID:                t.id,
+		Namespace:         *t.name,
+		Options:           t.options.Raw(),
+		Pool:              t.subnet.String(),
+		IpamPool:          t.ipamPool,
+		Endpoint:          t.endpointAddr().String(),
+		OutboundInterface: t.outboundIntf.Attrs().Name,
+		OutboundAddress:   t.outboundAddr.String(),
+		ListenPort:        t.conf.ListenPort,
+		Bridge:            t.gateway.Attrs().Name,
+		BridgeAddress:     t.bridgeNet.String(),
+		AuxAddresses:      t.auxAddressStrings(),
+		Endpoints:         endpoints,
+		MeshPeers:         t.meshPeerStates(),
+	}
+}
+
+func (t *Network) meshPeerStates() map[string]*MeshPeerState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	peers := make(map[string]*MeshPeerState, len(t.meshPeers))
+	for key, peer := range t.meshPeers {
+		allowed := make([]string, len(peer.AllowedIPs))
+		for i, n := range peer.AllowedIPs {
+			allowed[i] = n.String()
+		}
+		peers[key] = &MeshPeerState{Endpoint: peer.Endpoint, AllowedIPs: allowed}
+	}
+	return peers
+}
+
+func (t *Network) auxAddressStrings() map[string]string {
+	aux := make(map[string]string, len(t.auxAddresses))
+	for name, ip := range t.auxAddresses {
+		aux[name] = ip.String()
+	}
+	return aux
+}
+
+func (t *Network) SaveState() error {
+	if !t.persistent() {
+		return nil
+	}
+
+	return writeFileAtomic(networkStatePath(t.stateDir, t.id), t.State())
+}
+
+func (t *Network) removeState() error {
+	err := os.Remove(networkStatePath(t.stateDir, t.id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func LoadNetworkStates(stateDir string) ([]*NetworkState, error) {
+	paths, err := filepath.Glob(filepath.Join(stateDir, "networks", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	states := make([]*NetworkState, 0, len(paths))
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var state NetworkState
+		if err = json.Unmarshal(contents, &state); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+		}
+		states = append(states, &state)
+	}
+	return states, nil
+}
+
+func RemoveNetworkState(stateDir, id string) error {
+	err := os.Remove(networkStatePath(stateDir, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func parseAddr(addr string) (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipNet.IP = ip
+	return ipNet, nil
+}
+
+// Rebuilds a network from the state saved by a previous instance without
+// touching its dataplane, apart from restoring missing forwarding rules.
+func AdoptNetwork(lg *Logger, state *NetworkState, pool *ipamPool, rootNs netns.NsHandle, iptables *Iptables, stateDir string) (network *Network, err error) {
+	options, err := ParseNetworkOptions(state.Options)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := ParseWgConfig(options.String("wgconf"))
+	if err != nil {
+		return nil, err
+	}
+	global, err := parseGlobalTunnel(options)
+	if err != nil {
+		return nil, err
+	}
+	mesh, err := ParseMeshPolicy(options)
+	if err != nil {
+		return nil, err
+	}
+	rotation, err := ParseRotationPolicy(options)
+	if err != nil {
+		return nil, err
+	}
+	monitor := ParseMonitorPolicy(options)
+	vxlanPolicy := ParseVxlanPolicy(options)
+	keyPath := options.String("keyfile")
+	if keyPath == "" {
+		keyPath = filepath.Join(stateDir, "keys", state.ID+".key")
+	}
+
+	exportedPeers, err := loadExportedPeers(exportedPeersPath(stateDir, state.ID))
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range exportedPeers {
+		wgPeer := peer.WgPeer()
+		conf.Peers = append(conf.Peers, wgPeer)
+		conf.PeerNets = append(conf.PeerNets, wgPeer.AllowedIPs...)
+	}
+	meshPeers := make(map[string]*WgPeer, len(state.MeshPeers))
+	// Restored by the monitor like the ones set later
+	addedPeers := make(map[string]*WgPeer, len(state.MeshPeers))
+	for key, peerState := range state.MeshPeers {
+		peer := &WgPeer{PublicKey: key, Endpoint: peerState.Endpoint}
+		for _, str := range peerState.AllowedIPs {
+			_, n, err := net.ParseCIDR(str)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid allowed ip %s of mesh peer %s in saved state", str, key)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, n)
+		}
+		meshPeers[key] = peer
+		addedPeers[key] = peer
+		conf.Peers = append(conf.Peers, peer)
+		conf.PeerNets = append(conf.PeerNets, peer.AllowedIPs...)
+	}
+
+	ns, err := netns.GetFromName(state.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Namespace %s is gone: %v", state.Namespace, err)
+	}
+	defer func() {
+		if err != nil {
+			ns.Close()
+		}
+	}()
+	nl, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			nl.Delete()
+		}
+	}()
+	rootNl, err := netlink.NewHandleAt(rootNs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			rootNl.Delete()
+		}
+	}()
+
+	outboundIntf, err := rootNl.LinkByName(state.OutboundInterface)
+	if err != nil {
+		return nil, fmt.Errorf("Outbound link %s is gone: %v", state.OutboundInterface, err)
+	}
+	routed := options.Bool("routed")
+	gateway, err := nl.LinkByName(state.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("Bridge %s is gone: %v", state.Bridge, err)
+	}
+	bridge, ok := gateway.(*netlink.Bridge)
+	if !ok && !routed {
+		return nil, fmt.Errorf("Link %s is not a bridge", state.Bridge)
+	}
+
+	var link netlink.Link
+	var vxlan *netlink.Vxlan
+	if vxlanPolicy != nil {
+		if link, err = nl.LinkByName(vxlanName); err != nil {
+			return nil, fmt.Errorf("Vxlan interface %s is gone: %v", vxlanName, err)
+		}
+		if vxlan, ok = link.(*netlink.Vxlan); !ok {
+			return nil, fmt.Errorf("Link %s is not a vxlan interface", vxlanName)
+		}
+	}
+
+	var wgLink netlink.Link
+	links, err := nl.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link = range links {
+		if link.Type() == "wireguard" {
+			wgLink = link
+		}
+	}
+	if wgLink == nil {
+		return nil, fmt.Errorf("Wireguard interface is gone")
+	}
+	publicKey, err := wgCommand(ns, "", "show", wgLink.Attrs().Name, "public-key")
+	if err != nil {
+		return nil, err
+	}
+
+	_, subnet, err := net.ParseCIDR(state.Pool)
+	if err != nil {
+		return nil, err
+	}
+	bridgeNet, err := parseAddr(state.BridgeAddress)
+	if err != nil {
+		return nil, err
+	}
+	outboundAddr := net.ParseIP(state.OutboundAddress)
+	wgEndpoint := net.ParseIP(state.Endpoint)
+	if outboundAddr == nil || wgEndpoint == nil {
+		return nil, fmt.Errorf("Invalid addresses in saved state")
+	}
+
+	var ipAllocator *IpAllocator
+	if state.IpamPool != "" {
+		if pool == nil {
+			return nil, fmt.Errorf("Ipam pool %s of the network no longer exists", state.IpamPool)
+		}
+		ipAllocator = pool.allocator
+		markPeerAddresses(ipAllocator, subnet, conf.Peers)
+	} else {
+		ipAllocator, err = createNetworkAllocator(subnet, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ipAllocator.MarkUsed(conf.Net.IP)
+	ipAllocator.MarkUsed(bridgeNet.IP)
+	auxAddresses := make(map[string]net.IP, len(state.AuxAddresses))
+	for name, addr := range state.AuxAddresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid auxiliary address %s=%s in saved state", name, addr)
+		}
+		ipAllocator.MarkUsed(ip)
+		auxAddresses[name] = ip
+	}
+
+	endpoints := make(endpointTable, len(state.Endpoints))
+	for id, endpointState := range state.Endpoints {
+		var addr *net.IPNet
+		var mac net.HardwareAddr
+		if addr, err = parseAddr(endpointState.Address); err != nil {
+			return nil, err
+		}
+		if mac, err = net.ParseMAC(endpointState.MacAddress); err != nil {
+			return nil, err
+		}
+		ipAllocator.MarkUsed(addr.IP)
+		switch endpointState.Status {
+		case EndpointCreated, EndpointJoined, EndpointLeft:
+		default:
+			return nil, fmt.Errorf("Invalid status %q of endpoint %s in saved state", endpointState.Status, id)
+		}
+		endpoints[id] = &Endpoint{
+			Addr:      addr,
+			Mac:       mac,
+			Status:    endpointState.Status,
+			Interface: endpointState.Interface,
+			Sandbox:   endpointState.Sandbox,
+		}
+	}
+
+	repaired, err := iptables.RepairForwarding(rootNs, outboundAddr, wgEndpoint, conf.ListenPort)
+	if err != nil {
+		return nil, err
+	}
+	name := state.Namespace
+	network = &Network{
+		log:          logger.With("network", state.ID),
+		id:           state.ID,
+		stateDir:     stateDir,
+		keyPath:      keyPath,
+		options:      options,
+		ns:           ns,
+		nl:           nl,
+		rootNs:       rootNs,
+		rootNl:       rootNl,
+		name:         &name,
+		conf:         conf,
+		wgLink:       wgLink,
+		publicKey:    publicKey,
+		subnet:       subnet,
+		masquerade:   options.Bool("masquerade"),
+		routed:       routed,
+		bridge:       bridge,
+		gateway:      gateway,
+		bridgeNet:    bridgeNet,
+		auxAddresses: auxAddresses,
+		ipAllocator:  ipAllocator,
+		ipamPool:     state.IpamPool,
+		global:       global,
+		mesh:         mesh,
+		meshPeers:    meshPeers,
+		vxlan:        vxlan,
+		addedPeers:   addedPeers,
+		wgEndpoint:   wgEndpoint,
+		outboundAddr: outboundAddr,
+		outboundIntf: outboundIntf,
+		iptables:     iptables,
+		endpoints:    endpoints,
+		peerStatus:   make(map[string]*PeerStatus, 0),
+		stop:         make(chan struct{}),
+	}
+	for _, peer := range conf.Peers {
+		if err := network.updateFloodEntries(peer, false); err != nil {
+			lg.Warn("Failed to restore vxlan fdb entry", "peer", peer.PublicKey, "error", err)
+		}
+	}
+	network.startBackground(rotation, monitor, mesh)
+
+	lg.Info("Adopted network", "namespace", name, "endpoints", len(endpoints), "restored_rules", repaired)
+	return network, nil
+}
+
+// Tears down whatever is left of a network that could not be adopted, since
+// nothing but its state file leads back to it.
+func teardownNetworkState(state *NetworkState, rootNs netns.NsHandle, iptables *Iptables, stateDir string) error {
+	outboundAddr := net.ParseIP(state.OutboundAddress)
+	wgEndpoint := net.ParseIP(state.Endpoint)
+	if outboundAddr == nil || wgEndpoint == nil || state.ListenPort == 0 {
+		return fmt.Errorf("Invalid forwarding state for network %s: outbound address %q, endpoint %q, port %d", state.ID, state.OutboundAddress, state.Endpoint, state.ListenPort)
+	}
+
+	if _, err := os.Stat(filepath.Join("/var/run/netns", state.Namespace)); err == nil {
+		if err := netns.DeleteNamed(state.Namespace); err != nil {
+			return fmt.Errorf("Failed to delete namespace %s: %v", state.Namespace, err)
+		}
+	}
+
+	rootNl, err := netlink.NewHandleAt(rootNs)
+	if err != nil {
+		return err
+	}
+	defer rootNl.Delete()
+	if link, err := rootNl.LinkByName(state.OutboundInterface); err == nil {
+		if err = rootNl.LinkDel(link); err != nil {
+			return fmt.Errorf("Failed to delete link %s: %v", state.OutboundInterface, err)
+		}
+	}
+
+	if err = iptables.RemoveForwarding(rootNs, outboundAddr, wgEndpoint, state.ListenPort); err != nil {
+		return err
+	}
+
+	if err = releaseTransit(stateDir, state.ID); err != nil {
+		return err
+	}
+	return RemoveNetworkState(stateDir, state.ID)
+}
+
+// Stops managing the network but leaves it running, so that a new instance of
+// the driver can adopt it.
+func (t *Network) Detach() error {
+	close(t.stop)
+	t.background.Wait()
+	t.forwardingMu.Lock()
+	defer t.forwardingMu.Unlock()
+
+	err := t.SaveState()
+	t.nl.Delete()
+	t.rootNl.Delete()
+	if closeErr := t.ns.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Transit /31s connect each network namespace to the root namespace.  The
+// assignments are kept in the state directory so that a network gets the same
+// addresses back when it is created again, and so that networks that are not
+// currently up still keep their /31 reserved.
+
+func transitPath(stateDir string) string {
+	return filepath.Join(stateDir, "transit.json")
+}
+
+func loadTransit(stateDir string) (map[string]string, error) {
+	assignments := make(map[string]string, 0)
+	contents, err := ioutil.ReadFile(transitPath(stateDir))
+	if os.IsNotExist(err) {
+		return assignments, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(contents, &assignments); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", transitPath(stateDir), err)
+	}
+	return assignments, nil
+}
+
+func saveTransit(stateDir string, assignments map[string]string) error {
+	return writeFileAtomic(transitPath(stateDir), assignments)
+}
+
+func parseTransitRange(val string) (*net.IPNet, error) {
+	_, transit, err := net.ParseCIDR(val)
+	if err != nil {
+		return nil, err
+	}
+	if transit.IP.To4() == nil {
+		return nil, fmt.Errorf("must be an ipv4 range")
+	}
+	if ones, _ := transit.Mask.Size(); ones > 31 {
+		return nil, fmt.Errorf("must hold at least one /31")
+	}
+	return transit, nil
+}
+
+func validateTransitRange(val string) error {
+	_, err := parseTransitRange(val)
+	return err
+}
+
+// Lists the subnets of docker's own networks through its api.
+func dockerSubnets(socket string) ([]*net.IPNet, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+		// Docker may be waiting on this very plugin, don't hold it up for long
+		Timeout: 2 * time.Second,
+	}
+	resp, err := client.Get("http://docker/networks")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Docker responded with %s", resp.Status)
+	}
+
+	var networks []struct {
+		IPAM struct {
+			Config []struct {
+				Subnet string
+			}
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&networks); err != nil {
+		return nil, err
+	}
+	subnets := make([]*net.IPNet, 0)
+	for _, network := range networks {
+		for _, config := range network.IPAM.Config {
+			if _, subnet, err := net.ParseCIDR(config.Subnet); err == nil {
+				subnets = append(subnets, subnet)
+			}
+		}
+	}
+	return subnets, nil
+}
+
+// Docker's networks, or none if its api can't be reached.  Called without the
+// driver lock, since docker may be waiting on the plugin while we wait on it.
+func transitDockerSubnets(lg *Logger) []*net.IPNet {
+	socket := GetConfig().DockerSocket
+	if socket == "" {
+		return nil
+	}
+	subnets, err := dockerSubnets(socket)
+	if err != nil {
+		lg.Warn("Failed to list docker networks, not checking the transit range against them", "error", err)
+	}
+	return subnets
+}
+
+// Collects everything in the root namespace a transit /31 must not overlap:
+// addresses on links, routes in every table and the given docker networks.
+func transitConflicts(rootNl *netlink.Handle, dockerNets []*net.IPNet) ([]*net.IPNet, error) {
+	nets := append([]*net.IPNet(nil), dockerNets...)
+	addrs, err := allLinkNets(rootNl)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		nets = append(nets, &addrs[i])
+	}
+
+	filter := &netlink.Route{Table: syscall.RT_TABLE_UNSPEC}
+	routes, err := rootNl.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		// Default routes overlap everything
+		if route.Dst == nil {
+			continue
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		nets = append(nets, route.Dst)
+	}
+	return nets, nil
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func transitFree(pair *net.IPNet, used []*net.IPNet) bool {
+	for _, net := range used {
+		if overlaps(pair, net) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the root and namespace side addresses of the network's transit /31,
+// reusing the one it was assigned before if that is still free.
+func allocateTransit(lg *Logger, rootNl *netlink.Handle, stateDir, id string, transit *net.IPNet, dockerNets []*net.IPNet) (net.IP, net.IP, error) {
+	assignments, err := loadTransit(stateDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	used, err := transitConflicts(rootNl, dockerNets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var previous *net.IPNet
+	for netId, assigned := range assignments {
+		_, pair, err := net.ParseCIDR(assigned)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid transit assignment %q for %s", assigned, netId)
+		}
+		if netId == id {
+			previous = pair
+		} else {
+			used = append(used, pair)
+		}
+	}
+
+	var pair *net.IPNet
+	if previous != nil && transitFree(previous, used) {
+		pair = previous
+	} else {
+		if previous != nil {
+			lg.Warn("Previous transit addresses are now in use, picking new ones", "transit", previous)
+		}
+		base := bytesToUint(transit.IP.To4())
+		size := ^bytesToUint(transit.Mask) + 1
+		for i := uint32(0); i < size; i += 2 {
+			candidate := &net.IPNet{
+				IP:   net.IP(uintToBytes(base + i)),
+				Mask: net.CIDRMask(31, 32),
+			}
+			if transitFree(candidate, used) {
+				pair = candidate
+				break
+			}
+		}
+		if pair == nil {
+			return nil, nil, fmt.Errorf("Unable to find unused transit addresses in %s", transit)
+		}
+	}
+
+	assignments[id] = pair.String()
+	if err = saveTransit(stateDir, assignments); err != nil {
+		return nil, nil, err
+	}
+	lg.Debug("Assigned transit addresses", "transit", pair)
+
+	first := bytesToUint(pair.IP.To4())
+	return net.IP(uintToBytes(first)), net.IP(uintToBytes(first + 1)), nil
+}
+
+func releaseTransit(stateDir, id string) error {
+	assignments, err := loadTransit(stateDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := assignments[id]; !ok {
+		return nil
+	}
+	delete(assignments, id)
+	return saveTransit(stateDir, assignments)
+}
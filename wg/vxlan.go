@@ -0,0 +1,160 @@
+package wg
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// With the vxlan option the bridge gets a vxlan port that runs over the
+// tunnel, so containers on every host of the network share a broadcast
+// domain.  Broadcasts are replicated to the tunnel address of every peer
+// through all-zero fdb entries and unicast destinations are learned.  Hosts
+// share the subnet, so each needs its own ip_range and gateway, except for the
+// nodes of a global network which share the gateway docker allocated.
+
+const (
+	defaultVxlanId   = "1"
+	defaultVxlanPort = "4789"
+
+	vxlanName = "wgvxlan"
+	// Outer ipv4, udp and vxlan headers plus the inner ethernet header
+	vxlanOverhead = 50
+)
+
+type VxlanPolicy struct {
+	Id   int
+	Port int
+}
+
+func ParseVxlanPolicy(options *Options) *VxlanPolicy {
+	if !options.Bool("vxlan") {
+		return nil
+	}
+	id, _ := strconv.Atoi(options.String("vxlan_id"))
+	port, _ := strconv.Atoi(options.String("vxlan_port"))
+	return &VxlanPolicy{id, port}
+}
+
+func validateVxlanId(val string) error {
+	id, err := strconv.ParseUint(val, 10, 32)
+	if err == nil && (id == 0 || id >= 1<<24) {
+		err = fmt.Errorf("must be between 1 and %d", 1<<24-1)
+	}
+	return err
+}
+
+func createVxlan(nl *netlink.Handle, policy *VxlanPolicy, wgLink netlink.Link, local net.IP, bridge *netlink.Bridge) (*netlink.Vxlan, error) {
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: vxlanName,
+			MTU:  wgLink.Attrs().MTU - vxlanOverhead,
+		},
+		VxlanId:  policy.Id,
+		SrcAddr:  local,
+		Port:     policy.Port,
+		Learning: true,
+	}
+	if err := nl.LinkAdd(vxlan); err != nil {
+		return nil, fmt.Errorf("Failed to add vxlan interface: %v", err)
+	}
+	if err := nl.LinkSetMaster(vxlan, bridge); err != nil {
+		return nil, err
+	}
+	if err := nl.LinkSetUp(vxlan); err != nil {
+		return nil, err
+	}
+	return vxlan, nil
+}
+
+// Every host's bridge holds the gateway, the arp replies of hosts with the
+// same one would fight over the vxlan.  A gateway inside this host's ip_range
+// is its own, ranges overlapping would clash the hosts' containers too.
+func checkVxlanGateway(gateway net.IP, hostRange *net.IPNet) error {
+	if hostRange == nil {
+		return fmt.Errorf("Option vxlan requires an ip_range for the containers of this host, hosts share the subnet")
+	}
+	if !hostRange.Contains(gateway) {
+		return fmt.Errorf("Gateway %s is outside of this host's ip_range %s, with vxlan each host needs a gateway of its own", gateway, hostRange)
+	}
+	return nil
+}
+
+// Every node of a global network has the gateway docker allocated on its
+// bridge.  With the same mac everywhere the replies from other nodes to arp
+// requests that crossed the vxlan agree with the local one.
+func setAnycastGateway(nl *netlink.Handle, bridge *netlink.Bridge, gateway net.IP) error {
+	if err := nl.LinkSetHardwareAddr(bridge, macFromIP(gateway)); err != nil {
+		return fmt.Errorf("Failed to set gateway mac on bridge: %v", err)
+	}
+	return nil
+}
+
+// The addresses a peer terminates vxlan on: host routes inside the tunnel
+// subnet.
+func vxlanRemotes(tunnel *net.IPNet, peer *WgPeer) []net.IP {
+	remotes := make([]net.IP, 0, 1)
+	for _, n := range peer.AllowedIPs {
+		if prefix, bits := n.Mask.Size(); prefix == bits && tunnel.Contains(n.IP) {
+			remotes = append(remotes, n.IP)
+		}
+	}
+	return remotes
+}
+
+func floodEntry(vxlan netlink.Link, remote net.IP) *netlink.Neigh {
+	return &netlink.Neigh{
+		LinkIndex:    vxlan.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+		Flags:        netlink.NTF_SELF,
+		IP:           remote,
+		HardwareAddr: make(net.HardwareAddr, 6),
+	}
+}
+
+// Adds or, with remove set, deletes the flood entries of a peer.
+func setFloodEntries(lg *Logger, nl *netlink.Handle, vxlan netlink.Link, tunnel *net.IPNet, peer *WgPeer, remove bool) error {
+	remotes := vxlanRemotes(tunnel, peer)
+	if len(remotes) == 0 && !remove {
+		// A hub routing the whole tunnel subnet, say, gets no broadcasts
+		lg.Warn("Peer has no host address in the tunnel subnet, its hosts are not reached over vxlan", "peer", peer.PublicKey, "tunnel", tunnel, "allowed_ips", joinNets(peer.AllowedIPs))
+	}
+	for _, remote := range remotes {
+		neigh := floodEntry(vxlan, remote)
+		var err error
+		if remove {
+			err = nl.NeighDel(neigh)
+			if err == syscall.ENOENT {
+				err = nil
+			}
+		} else {
+			err = nl.NeighAppend(neigh)
+			if err == syscall.EEXIST {
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to update vxlan fdb entry for %s: %v", remote, err)
+		}
+	}
+	return nil
+}
+
+// Does nothing unless the network runs vxlan.
+func (t *Network) updateFloodEntries(peer *WgPeer, remove bool) error {
+	if t.vxlan == nil {
+		return nil
+	}
+	return setFloodEntries(t.log, t.nl, t.vxlan, t.conf.Net, peer, remove)
+}
+
+func (t *Network) containerMTU() int {
+	if t.vxlan == nil {
+		return 0
+	}
+	return t.vxlan.Attrs().MTU
+}
@@ -2,7 +2,6 @@ package wg
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"os/exec"
 	"runtime"
@@ -14,11 +13,19 @@ import (
 	"gopkg.in/go-ini/ini.v1"
 )
 
+type WgPeer struct {
+	PublicKey  string
+	Endpoint   string
+	AllowedIPs []*net.IPNet
+}
+
 type WgConfig struct {
-	Path       string
-	ListenPort uint
-	Net        *net.IPNet
-	PeerNets   []*net.IPNet
+	Path          string
+	ListenPort    uint
+	Net           *net.IPNet
+	PeerNets      []*net.IPNet
+	Peers         []*WgPeer
+	HasPrivateKey bool
 }
 
 func ParseWgConfig(path string) (*WgConfig, error) {
@@ -56,50 +63,54 @@ func ParseWgConfig(path string) (*WgConfig, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Num sections: %v\n", len(sections))
 	PeerNets := make([]*net.IPNet, 0)
+	Peers := make([]*WgPeer, 0, len(sections))
 	for _, section := range sections {
-		key, err := section.GetKey("AllowedIPs")
+		key, err := section.GetKey("PublicKey")
+		if err != nil {
+			return nil, err
+		}
+		peer := &WgPeer{
+			PublicKey:  key.String(),
+			Endpoint:   section.Key("Endpoint").String(),
+			AllowedIPs: make([]*net.IPNet, 0),
+		}
+
+		key, err = section.GetKey("AllowedIPs")
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("AllowedIps: %s\n", key.Value())
 		for _, addr := range key.Strings(",") {
 			_, peerNet, err := net.ParseCIDR(strings.TrimSpace(addr))
 			if err != nil {
 				return nil, err
 			}
 			PeerNets = append(PeerNets, peerNet)
+			peer.AllowedIPs = append(peer.AllowedIPs, peerNet)
 		}
+		Peers = append(Peers, peer)
 	}
 
+	HasPrivateKey := intf.HasKey("PrivateKey")
+
 	Path := path
-	return &WgConfig{Path, ListenPort, Net, PeerNets}, nil
+	return &WgConfig{Path, ListenPort, Net, PeerNets, Peers, HasPrivateKey}, nil
 }
 
-func (t *WgConfig) StartInterface(nl *netlink.Handle) (netlink.Link, error) {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
-
-	currentNs, err := netns.Get()
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		netns.Set(currentNs)
-		_ = currentNs.Close()
-	}()
-
-	// TODO: We should maybe set the netns here
-
-	log.Printf("Bringing up wireguard interface at %s\n", t.Path)
-	cmd := exec.Command("wg-quick", "up", t.Path)
-	output, err := cmd.CombinedOutput()
+func (t *WgConfig) StartInterface(lg *Logger, ns netns.NsHandle, nl *netlink.Handle) (netlink.Link, error) {
+	lg.Info("Bringing up wireguard interface", "config", t.Path)
+	err := inNamespace(ns, func() error {
+		output, err := exec.Command("wg-quick", "up", t.Path).CombinedOutput()
+		if err != nil {
+			lg.Error("wg-quick up failed", "error", err, "output", string(output))
+			return err
+		}
+		lg.Debug("wg-quick up finished", "output", string(output))
+		return nil
+	})
 	if err != nil {
-		log.Printf("Command failed: %v\n", err)
 		return nil, err
 	}
-	log.Printf("Output: %s\n", string(output))
 
 	links, err := nl.LinkList()
 	if err != nil {
@@ -115,6 +126,17 @@ func (t *WgConfig) StartInterface(nl *netlink.Handle) (netlink.Link, error) {
 	return nil, fmt.Errorf("Wireguard interface not found")
 }
 
+func (t *WgConfig) StopInterface(lg *Logger, ns netns.NsHandle) error {
+	lg.Info("Bringing down wireguard interface", "config", t.Path)
+	return inNamespace(ns, func() error {
+		output, err := exec.Command("wg-quick", "down", t.Path).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("wg-quick down failed: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+}
+
 func (t *WgConfig) GetRoutes(gateway net.IP) []*network.StaticRoute {
 	routes := make([]*network.StaticRoute, len(t.PeerNets))
 	for i, peer := range t.PeerNets {
@@ -126,3 +148,50 @@ func (t *WgConfig) GetRoutes(gateway net.IP) []*network.StaticRoute {
 	}
 	return routes
 }
+
+// Runs the wg tool inside the given namespace, optionally feeding it stdin.
+func wgCommand(ns netns.NsHandle, stdin string, args ...string) (string, error) {
+	var output string
+	err := inNamespace(ns, func() error {
+		var err error
+		output, err = wgTool(stdin, args...)
+		return err
+	})
+	return output, err
+}
+
+func wgTool(stdin string, args ...string) (string, error) {
+	cmd := exec.Command("wg", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("wg %s failed: %v: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("wg %s failed: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Runs fn on a thread that has been moved into the given namespace.
+func inNamespace(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	currentNs, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		netns.Set(currentNs)
+		_ = currentNs.Close()
+	}()
+
+	err = netns.Set(ns)
+	if err != nil {
+		return err
+	}
+	return fn()
+}